@@ -0,0 +1,179 @@
+// Package acl filters clients by ip with CIDR allow and deny rules
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// List is a set of allow and deny rules.
+// Deny rules win, and when allow rules are present only matching clients are allowed.
+// A nil List allows everything.
+type List struct {
+	m     sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	// static rules, kept when reloading the rules file
+	staticAllow []*net.IPNet
+	staticDeny  []*net.IPNet
+	file        string
+}
+
+// New creates a list from allow and deny CIDRs, plus the rules of file if not empty.
+// Plain ips are accepted as single host networks.
+func New(allow []string, deny []string, file string) (*List, error) {
+	l := &List{file: file}
+
+	var err error
+	if l.staticAllow, err = parseAll(allow); err != nil {
+		return nil, err
+	}
+	if l.staticDeny, err = parseAll(deny); err != nil {
+		return nil, err
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parse parses a CIDR or a plain ip
+func parse(rule string) (*net.IPNet, error) {
+	if !strings.Contains(rule, "/") {
+		ip := net.ParseIP(rule)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", rule)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(rule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", rule)
+	}
+	return network, nil
+}
+
+func parseAll(rules []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, rule := range rules {
+		network, err := parse(strings.TrimSpace(rule))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// readFile reads a rules file made of "allow <cidr>" and "deny <cidr>" lines.
+// Empty lines and lines starting with # are ignored.
+func readFile(file string) ([]*net.IPNet, []*net.IPNet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var allow, deny []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%s:%d: expected \"allow <cidr>\" or \"deny <cidr>\"", file, line)
+		}
+		network, err := parse(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, network)
+		case "deny":
+			deny = append(deny, network)
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown action %q", file, line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+// Reload reads the rules file again. On error, the current rules are kept.
+func (l *List) Reload() error {
+	var fileAllow, fileDeny []*net.IPNet
+	if l.file != "" {
+		var err error
+		if fileAllow, fileDeny, err = readFile(l.file); err != nil {
+			return err
+		}
+	}
+
+	allow := append(append([]*net.IPNet(nil), l.staticAllow...), fileAllow...)
+	deny := append(append([]*net.IPNet(nil), l.staticDeny...), fileDeny...)
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.allow = allow
+	l.deny = deny
+	return nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if ip passes the rules
+func (l *List) Allowed(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	if contains(l.deny, ip) {
+		return false
+	}
+	return len(l.allow) == 0 || contains(l.allow, ip)
+}
+
+// AllowedAddr returns true if the ip of a "host:port" or net.Addr string passes the rules.
+// Addresses without an ip, such as unix sockets, are allowed.
+func (l *List) AllowedAddr(addr string) bool {
+	if l == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	// Strip ipv6 zone
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	return l.Allowed(ip)
+}
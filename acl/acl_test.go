@@ -0,0 +1,108 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	l, err := New([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, expected := range map[string]bool{
+		"10.0.0.1:1234":       true,
+		"10.1.2.3:1234":       false,
+		"10.2.3.4:80":         false,
+		"10.2.3.5:80":         true,
+		"192.168.1.1:80":      false,
+		"[2001:db8::1]:80":    true,
+		"[2001:db9::1]:80":    false,
+		"/tmp/unix.sock":      true,
+		"[fe80::1%eth0]:8080": false,
+	} {
+		if l.AllowedAddr(addr) != expected {
+			t.Errorf("%s: expected allowed %v", addr, expected)
+		}
+	}
+}
+
+func TestDenyOnly(t *testing.T) {
+	l, err := New(nil, []string{"127.0.0.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.AllowedAddr("127.0.0.1:80") {
+		t.Error("127.0.0.1 should be denied")
+	}
+	if !l.AllowedAddr("127.0.0.2:80") {
+		t.Error("127.0.0.2 should be allowed")
+	}
+
+	var none *List
+	if !none.AllowedAddr("127.0.0.1:80") {
+		t.Error("nil list should allow everything")
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := New([]string{"10.0.0.0/33"}, nil, ""); err == nil {
+		t.Error("expected invalid CIDR error")
+	}
+	if _, err := New(nil, []string{"nope"}, ""); err == nil {
+		t.Error("expected invalid ip error")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules")
+
+	if err := ioutil.WriteFile(file, []byte("# local only\nallow 127.0.0.0/8\n\ndeny 127.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(nil, []string{"127.0.0.3"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:80": true,
+		"127.0.0.2:80": false,
+		"127.0.0.3:80": false,
+		"10.0.0.1:80":  false,
+	} {
+		if l.AllowedAddr(addr) != expected {
+			t.Errorf("%s: expected allowed %v", addr, expected)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("allow 10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if l.AllowedAddr("127.0.0.1:80") || !l.AllowedAddr("10.0.0.1:80") {
+		t.Error("reload should replace file rules")
+	}
+	if l.AllowedAddr("127.0.0.3:80") {
+		t.Error("reload should keep static rules")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("permit 10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err == nil {
+		t.Error("expected reload error")
+	}
+	if !l.AllowedAddr("10.0.0.1:80") {
+		t.Error("failed reload should keep current rules")
+	}
+}
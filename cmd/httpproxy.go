@@ -0,0 +1,80 @@
+// Copyright © 2018 Pierre Poissinger <pierre.poissinger@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pijalu/kitchensink/tool/httpproxy"
+	"github.com/spf13/cobra"
+)
+
+var httpProxyServer httpproxy.Server
+
+// httpProxyAccessLog is the access log file, - for stdout
+var httpProxyAccessLog *string
+
+// httpProxyCmd represents the httpproxy command
+var httpProxyCmd = &cobra.Command{
+	Use:   "httpproxy [bind.address]:port",
+	Short: "Start a HTTP forward proxy",
+	Long:  `This command will start a HTTP/1.1 forward proxy handling absolute URI requests and CONNECT tunnels, usable through the HTTP_PROXY and HTTPS_PROXY environment variables`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		httpProxyServer.SourceAddr = &args[0]
+
+		var err error
+		if httpProxyServer.ACL, err = accessList(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		switch *httpProxyAccessLog {
+		case "":
+		case "-":
+			httpProxyServer.AccessLog = os.Stdout
+		default:
+			f, err := os.OpenFile(*httpProxyAccessLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			httpProxyServer.AccessLog = f
+		}
+
+		if err := httpProxyServer.Run(signalContext()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(httpProxyCmd)
+
+	httpProxyServer = httpproxy.Server{
+		QuietFlag:   &quietFlag,
+		DialTimeOut: httpProxyCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
+		Username:    httpProxyCmd.Flags().StringP("user", "u", "", "Username clients must authenticate with, no authentication if empty."),
+		Password:    httpProxyCmd.Flags().StringP("password", "w", "", "Password clients must authenticate with."),
+	}
+	httpProxyCmd.Flags().StringSliceVar(&httpProxyServer.AllowedHosts, "allow-host", nil, "Only proxy to these hosts, a leading dot also matches subdomains.")
+	httpProxyAccessLog = httpProxyCmd.Flags().String("access-log", "", "Append a line per request to this file, - for stdout.")
+	addACLFlags(httpProxyCmd)
+}
@@ -16,25 +16,84 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/pijalu/kitchensink/quietlog"
 	"github.com/pijalu/kitchensink/tool/proxy"
 	"github.com/spf13/cobra"
 )
 
 var pxy proxy.Proxy
 
+// proxySelfSigned makes the proxy terminate tls with a generated certificate
+var proxySelfSigned *bool
+
+// proxyImpairment holds the initial network impairment of the proxy
+var proxyImpairment proxy.Impairment
+
+// proxyForwards are the extra listen=target pairs of the proxy
+var proxyForwards []string
+
 // proxyCmd represents the proxy command
 var proxyCmd = &cobra.Command{
-	Use:   "proxy [bind.address]:port target:port",
+	Use:   "proxy [[bind.address]:port target:port [target:port...]] [--forward listen=target...]",
 	Short: "Start a proxy server to connect to a remote address",
-	Long:  `This command will start a proxy server that will forward all packet to a given address/port. This can be used to create a reroute to a remote ip:port`,
-	Args:  cobra.ExactArgs(2),
+	Long:  `This command will start a proxy server that will forward all packet to a given address/port. This can be used to create a reroute to a remote ip:port. When several targets are given, connections are balanced between them. Each --forward adds a listen=target pair with its own accept loop, ports can be ranges like :8000-8010=db:5000-5010. Over tcp, each address can pick its own network with a tcp://, tcp4://, tcp6:// or unix:// scheme, for instance to expose unix:///var/run/docker.sock on tcp://0.0.0.0:2375`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 || (len(args) == 0 && len(proxyForwards) == 0) {
+			return errors.New("requires a bind address and a target, or a --forward")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		pxy.SourceAddr = &args[0]
-		pxy.TargetAddr = &args[1]
+		if len(args) > 0 {
+			pxy.SourceAddr = &args[0]
+			pxy.TargetAddrs = args[1:]
+		}
+		for _, spec := range proxyForwards {
+			forwards, err := proxy.ParseForward(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			pxy.Forwards = append(pxy.Forwards, forwards...)
+		}
+
+		if *proxySelfSigned && strings.HasPrefix(*pxy.Protocol, "udp") {
+			fmt.Fprintln(os.Stderr, "tls termination is not supported over udp")
+			os.Exit(1)
+		}
+		if *proxySelfSigned && *pxy.TLSCertFile == "" {
+			var host string
+			if len(args) > 0 {
+				host = args[0]
+			} else {
+				host = pxy.Forwards[0].Source
+			}
+			cert, key, err := selfSignedCert(quietlog.DefaultLogger(&pxy), "proxy", host)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			pxy.TLSCertFile = &cert
+			pxy.TLSKeyFile = &key
+		}
+
+		var err error
+		if pxy.ACL, err = accessList(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 
-		pxy.Run()
+		serveMetrics(metricsAddr)
+		if err := pxy.Run(signalContext()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -42,8 +101,60 @@ func init() {
 	rootCmd.AddCommand(proxyCmd)
 
 	pxy = proxy.Proxy{
-		Protocol:    proxyCmd.Flags().StringP("protocol", "p", "tcp", "Protocol: tcp or udp."),
-		DialTimeOut: proxyCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
-		QuietFlag:   &quietFlag,
+		Protocol:         proxyCmd.Flags().StringP("protocol", "p", "tcp", "Protocol: tcp or udp, used by addresses without scheme."),
+		DialTimeOut:      proxyCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
+		Balance:          proxyCmd.Flags().StringP("balance", "b", proxy.RoundRobin, "Balancing strategy: roundrobin, leastconn, random or sourcehash."),
+		HealthInterval:   proxyCmd.Flags().Duration("health-interval", 0, "Delay between target health checks, 0 to disable them."),
+		HealthRise:       proxyCmd.Flags().Int("health-rise", 2, "Successful health checks to put a target back in rotation."),
+		HealthFall:       proxyCmd.Flags().Int("health-fall", 3, "Failed health checks to take a target out of rotation."),
+		HealthHTTPPath:   proxyCmd.Flags().String("health-http", "", "Use a http GET on this path for health checks instead of a tcp connect."),
+		DialRetries:      proxyCmd.Flags().Int("retries", 0, "Number of dial retries over all targets before dropping a connection."),
+		RetryBackoff:     proxyCmd.Flags().Duration("retry-backoff", 500*time.Millisecond, "Delay before the first dial retry, doubled on each retry."),
+		BreakerThreshold: proxyCmd.Flags().Int("breaker-threshold", 0, "Failed dials in a row opening the circuit breaker of a target, 0 to disable it."),
+		BreakerCooldown:  proxyCmd.Flags().Duration("breaker-cooldown", 30*time.Second, "Time a target is skipped once its circuit breaker opened."),
+		TLSCertFile:      proxyCmd.Flags().String("tls-cert", "", "Certificate file to accept tls connections, forwarded as plaintext to the target."),
+		TLSKeyFile:       proxyCmd.Flags().String("tls-key", "", "Private key file of the tls certificate."),
+		TLSClientCAFile:  proxyCmd.Flags().String("tls-client-ca", "", "CA bundle to verify tls client certificates against."),
+		TargetTLS:        proxyCmd.Flags().Bool("target-tls", false, "Dial targets over tls."),
+		TargetSNI:        proxyCmd.Flags().String("target-sni", "", "Server name sent to and verified against tls targets, defaults to the target host."),
+		TargetCAFile:     proxyCmd.Flags().String("target-ca", "", "CA bundle to verify tls targets against instead of the system roots."),
+		TargetCertFile:   proxyCmd.Flags().String("target-cert", "", "Client certificate file presented to tls targets."),
+		TargetKeyFile:    proxyCmd.Flags().String("target-key", "", "Private key file of the target client certificate."),
+		TargetInsecure:   proxyCmd.Flags().Bool("target-insecure", false, "Skip tls target certificate verification."),
+		SendProxy:        proxyCmd.Flags().String("send-proxy", "", "Send a PROXY protocol header to targets: v1 or v2."),
+		AcceptProxy:      proxyCmd.Flags().Bool("accept-proxy", false, "Require clients to send a PROXY protocol header giving the real client address."),
+		CaptureFile:      proxyCmd.Flags().String("capture", "", "Record proxied tcp connections in this pcap file."),
+		Dump:             proxyCmd.Flags().String("dump", "", "Print proxied data: hex, text or both."),
+		DumpMax:          proxyCmd.Flags().Int("dump-max", 0, "Maximum number of bytes printed per chunk, 0 for no limit."),
+		Impairment:       &proxyImpairment,
+		AdminAddr:        proxyCmd.Flags().String("admin-listen", "", "Listen address of the admin http api, disabled if empty."),
+		MaxConns:         proxyCmd.Flags().Int("max-conns", 0, "Maximum number of concurrent connections, 0 for no limit."),
+		MaxConnsPerIP:    proxyCmd.Flags().Int("max-conns-per-ip", 0, "Maximum number of concurrent connections from a single client ip, 0 for no limit."),
+		AcceptRate:       proxyCmd.Flags().Float64("accept-rate", 0, "Maximum number of accepted connections per second, 0 for no limit."),
+		AcceptBurst:      proxyCmd.Flags().Int("accept-burst", 1, "Number of connections accepted at once above the accept rate."),
+		LimitWait:        proxyCmd.Flags().Duration("limit-wait", 0, "Queue connections over a limit for up to this duration instead of rejecting them."),
+		IdleTimeout:      proxyCmd.Flags().Duration("idle-timeout", 0, "Close connections without traffic in either direction for this duration, 0 to disable it."),
+		MaxLifetime:      proxyCmd.Flags().Duration("max-lifetime", 0, "Close connections open for this duration, 0 for no limit."),
+		DrainTimeout:     proxyCmd.Flags().Duration("drain-timeout", 10*time.Second, "Time given to open connections to finish on shutdown."),
+		QuietFlag:        &quietFlag,
+		UDPIdleTimeout:   proxyCmd.Flags().Duration("udp-idle", 60*time.Second, "Close udp client sessions after this idle time."),
 	}
+	proxyCmd.Flags().DurationVar(&proxyImpairment.Latency, "latency", 0, "Latency added to each proxied chunk.")
+	proxyCmd.Flags().DurationVar(&proxyImpairment.Jitter, "jitter", 0, "Random delay added to or removed from the latency.")
+	proxyCmd.Flags().Int64Var(&proxyImpairment.RateUp, "rate-up", 0, "Client to target bandwidth in bytes per second, 0 for no limit.")
+	proxyCmd.Flags().Int64Var(&proxyImpairment.RateDown, "rate-down", 0, "Target to client bandwidth in bytes per second, 0 for no limit.")
+	proxyCmd.Flags().Float64Var(&proxyImpairment.ResetProbability, "reset-probability", 0, "Probability to reset a connection on each chunk.")
+	proxyCmd.Flags().Float64Var(&proxyImpairment.StallProbability, "stall-probability", 0, "Probability to stall a connection on each chunk.")
+	proxyCmd.Flags().DurationVar(&proxyImpairment.StallDuration, "stall-duration", 5*time.Second, "Duration of a connection stall.")
+	proxySelfSigned = proxyCmd.Flags().Bool("tls-self-signed", false,
+		fmt.Sprintf("Accept tls connections using %sproxy-cert.pem and %sproxy-key.pem. If not present, these files will be created",
+			secretDirectory(),
+			secretDirectory()))
+	addACLFlags(proxyCmd)
+	pxy.SocketMode = proxyCmd.Flags().String("socket-mode", "", "Octal permissions of a unix socket listen address, like 0660.")
+	pxy.RecordFile = proxyCmd.Flags().String("record", "", "Record proxied connections in this session file, see the replay command.")
+	pxy.Mirror = proxyCmd.Flags().String("mirror", "", "Copy client data to this host:port too, throwing its responses away.")
+	proxyCmd.Flags().StringArrayVar(&proxyForwards, "forward", nil, "Also listen on this address: listen=target[,target...], ports can be ranges like :8000-8010=db:5000-5010.")
+	proxyCmd.Flags().StringArrayVar(&pxy.SNIRoutes, "sni-route", nil, "Route tls clients by server name without terminating tls: host=target, host can start with *. to match subdomains. Unmatched clients go to the default targets.")
+	proxyCmd.Flags().StringVar(&metricsAddr, "metrics-listen", "", "Listen address of the prometheus /metrics endpoint, disabled if empty.")
 }
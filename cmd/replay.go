@@ -0,0 +1,78 @@
+// Copyright © 2018 Pierre Poissinger <pierre.poissinger@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pijalu/kitchensink/tool/replay"
+	"github.com/spf13/cobra"
+)
+
+var replayListen *string
+var replayConnect *string
+var replayTimeout *time.Duration
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay session.file",
+	Short: "Replay tcp sessions recorded by the proxy",
+	Long:  `This command replays a session file recorded with proxy --record. With --listen, it acts as a fake server answering clients from the recording. With --connect, it acts as a client sending the recorded requests to a target at the original pace, and fails if the answers differ from the recording`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if (*replayListen == "") == (*replayConnect == "") {
+			fmt.Fprintln(os.Stderr, "exactly one of --listen or --connect is required")
+			os.Exit(1)
+		}
+
+		sessions, err := replay.LoadSessions(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *replayListen != "" {
+			server := replay.Server{
+				QuietFlag:  &quietFlag,
+				SourceAddr: replayListen,
+				Sessions:   sessions,
+			}
+			err = server.Run(signalContext())
+		} else {
+			client := replay.Client{
+				QuietFlag:  &quietFlag,
+				TargetAddr: replayConnect,
+				Sessions:   sessions,
+				Timeout:    replayTimeout,
+			}
+			err = client.Run(signalContext())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayListen = replayCmd.Flags().StringP("listen", "l", "", "Act as the recorded target on this [bind.address]:port.")
+	replayConnect = replayCmd.Flags().StringP("connect", "c", "", "Act as the recorded clients against this target:port.")
+	replayTimeout = replayCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect and for each expected answer.")
+}
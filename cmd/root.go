@@ -16,10 +16,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pijalu/kitchensink/acl"
+	"github.com/pijalu/kitchensink/metrics"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -29,6 +35,14 @@ const version = "0.1"
 var cfgFile string
 var quietFlag bool
 
+// metricsAddr is the listen address of the prometheus metrics endpoint
+var metricsAddr string
+
+// client access rules
+var aclAllow []string
+var aclDeny []string
+var aclFile string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:     "kitchensink",
@@ -57,6 +71,77 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&quietFlag, "quiet", "q", false, "Be quiet.")
 }
 
+// signalContext returns a context cancelled on SIGINT or SIGTERM.
+// A second signal exits immediately.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		if !quietFlag {
+			fmt.Fprintf(os.Stderr, "Got %s, shutting down\n", sig)
+		}
+		cancel()
+
+		<-signals
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// serveMetrics exposes /metrics on addr in the background, if addr is not empty
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "Error serving metrics on %s: %v\n", addr, err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// addACLFlags adds the client access rules flags to cmd
+func addACLFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&aclAllow, "allow", nil, "Only accept clients from these CIDRs or ips.")
+	cmd.Flags().StringSliceVar(&aclDeny, "deny", nil, "Reject clients from these CIDRs or ips.")
+	cmd.Flags().StringVar(&aclFile, "acl-file", "", "File of \"allow <cidr>\" and \"deny <cidr>\" lines, reloaded on SIGHUP.")
+}
+
+// accessList returns the client access rules, or nil if none is set.
+// The rules file is reloaded on SIGHUP.
+func accessList() (*acl.List, error) {
+	if len(aclAllow) == 0 && len(aclDeny) == 0 && aclFile == "" {
+		return nil, nil
+	}
+	list, err := acl.New(aclAllow, aclDeny, aclFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if aclFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := list.Reload(); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload %s, keeping current rules: %v\n", aclFile, err)
+				} else if !quietFlag {
+					fmt.Fprintf(os.Stderr, "Reloaded %s\n", aclFile)
+				}
+			}
+		}()
+	}
+	return list, nil
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
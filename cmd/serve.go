@@ -21,10 +21,15 @@ import (
 	"net/http"
 	"os"
 	"os/user"
+	"strconv"
 	"time"
 
 	"github.com/kabukky/httpscerts"
+	"github.com/pijalu/kitchensink/acl"
+	"github.com/pijalu/kitchensink/httprec"
+	"github.com/pijalu/kitchensink/metrics"
 	"github.com/pijalu/kitchensink/quietlog"
+	"github.com/pijalu/kitchensink/tool/reverseproxy"
 	"github.com/spf13/cobra"
 )
 
@@ -33,6 +38,11 @@ type serveConfig struct {
 	servePath *string
 	useSSL    *bool
 	QuietFlag *bool
+
+	routes        *[]string
+	headerSet     *[]string
+	headerRemove  *[]string
+	headerRewrite *[]string
 }
 
 func (s *serveConfig) Quiet() bool {
@@ -41,6 +51,69 @@ func (s *serveConfig) Quiet() bool {
 
 var serveCfg serveConfig
 
+var serveRequests = metrics.NewCounter("kitchensink_serve_requests_total",
+	"Number of served http requests.", "code", "method")
+
+// serveHandler returns the static file server, behind a router if routes are configured
+func serveHandler(log *quietlog.QuietLogger) (http.Handler, error) {
+	fs := http.FileServer(http.Dir(*serveCfg.servePath))
+	if len(*serveCfg.routes) == 0 {
+		return fs, nil
+	}
+
+	var routes []reverseproxy.Route
+	for _, spec := range *serveCfg.routes {
+		route, err := reverseproxy.ParseRoute(spec)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Routing %s%s to %s", route.Host, route.Prefix, route.Target)
+		routes = append(routes, route)
+	}
+
+	var headers []reverseproxy.HeaderRule
+	for _, rules := range []struct {
+		specs *[]string
+		parse func(string) (reverseproxy.HeaderRule, error)
+	}{
+		{serveCfg.headerSet, reverseproxy.ParseHeaderSet},
+		{serveCfg.headerRemove, reverseproxy.ParseHeaderRemove},
+		{serveCfg.headerRewrite, reverseproxy.ParseHeaderRewrite},
+	} {
+		for _, spec := range *rules.specs {
+			rule, err := rules.parse(spec)
+			if err != nil {
+				return nil, err
+			}
+			headers = append(headers, rule)
+		}
+	}
+
+	router := reverseproxy.NewRouter(routes, headers, fs)
+	router.Log = log
+	return router, nil
+}
+
+// allowClients rejects requests from clients denied by list
+func allowClients(list *acl.List, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !list.AllowedAddr(r.RemoteAddr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// countRequests counts requests served by h
+func countRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httprec.New(w)
+		h.ServeHTTP(rec, r)
+		serveRequests.Inc(strconv.Itoa(rec.Status), r.Method)
+	})
+}
+
 func secretDirectory() string {
 	// Get current user
 	user, err := user.Current()
@@ -54,6 +127,24 @@ func secretDirectory() string {
 		os.PathSeparator)
 }
 
+// selfSignedCert returns the certificate and key files named after name in the secret directory.
+// If not present, these files are generated for host.
+func selfSignedCert(log *quietlog.QuietLogger, name string, host string) (string, string, error) {
+	secretDir := secretDirectory()
+	cert := fmt.Sprintf("%s%s-cert.pem", secretDir, name)
+	key := fmt.Sprintf("%s%s-key.pem", secretDir, name)
+	if err := httpscerts.Check(cert, key); err != nil {
+		if err := os.MkdirAll(secretDir, 0755); err != nil {
+			return "", "", fmt.Errorf("failed to create secret directory: %v", err)
+		}
+		log.Printf("Generating new certificate in %s", secretDir)
+		if err := httpscerts.Generate(cert, key, host); err != nil {
+			return "", "", fmt.Errorf("failed to generate certificate: %v", err)
+		}
+	}
+	return cert, key, nil
+}
+
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
@@ -62,7 +153,11 @@ var serveCmd = &cobra.Command{
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		log := quietlog.DefaultLogger(&serveCfg)
-		_ = log
+		list, err := accessList()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		log.Printf("Starting server %s for %s",
 			*serveCfg.bindAddr,
 			*serveCfg.servePath)
@@ -86,26 +181,30 @@ var serveCmd = &cobra.Command{
 			WriteTimeout: 10 * time.Second,
 			IdleTimeout:  120 * time.Second,
 			TLSConfig:    tlsConfig,
+			Handler:      countRequests(allowClients(list, http.DefaultServeMux)),
+		}
+
+		handler, err := serveHandler(log)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		http.Handle("/", handler)
+		if len(*serveCfg.routes) > 0 {
+			// Routed requests can be long calls, uploads or streams: only limit reading headers
+			srv.ReadTimeout = 0
+			srv.WriteTimeout = 0
+			srv.ReadHeaderTimeout = 5 * time.Second
 		}
 
-		fs := http.FileServer(http.Dir(*serveCfg.servePath))
-		http.Handle("/", fs)
+		serveMetrics(metricsAddr)
 
-		var err error
 		if *serveCfg.useSSL {
-			secretDir := secretDirectory()
-			cert := fmt.Sprintf("%s%s", secretDir, "serve-cert.pem")
-			key := fmt.Sprintf("%s%s", secretDir, "serve-key.pem")
-			if err := httpscerts.Check(cert, key); err != nil {
-				if err := os.MkdirAll(secretDir, 0755); err != nil {
-					log.Printf("Failed to create secret directory: %v", err)
-					os.Exit(1)
-				}
-				log.Printf("Generating new certificate in %s", secretDir)
-				if err := httpscerts.Generate(cert, key, *serveCfg.bindAddr); err != nil {
-					log.Printf("Failed to generate certificate: %v", err)
-					os.Exit(1)
-				}
+			var cert, key string
+			cert, key, err = selfSignedCert(log, "serve", *serveCfg.bindAddr)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
 			err = srv.ListenAndServeTLS(cert, key)
 		} else {
@@ -129,4 +228,10 @@ func init() {
 				secretDirectory(),
 				secretDirectory())),
 	}
+	serveCfg.routes = serveCmd.Flags().StringArray("route", nil, "Proxy requests to an upstream instead of serving files: [host]/prefix=http://upstream[/path][,strip]. strip removes the prefix from the upstream path.")
+	serveCfg.headerSet = serveCmd.Flags().StringArray("header-set", nil, "Set a header on routed requests: Name=value.")
+	serveCfg.headerRemove = serveCmd.Flags().StringArray("header-remove", nil, "Remove a header from routed requests.")
+	serveCfg.headerRewrite = serveCmd.Flags().StringArray("header-rewrite", nil, "Rewrite a header of routed requests: Name=regexp=>replacement.")
+	addACLFlags(serveCmd)
+	serveCmd.Flags().StringVar(&metricsAddr, "metrics-listen", "", "Listen address of the prometheus /metrics endpoint, disabled if empty.")
 }
@@ -0,0 +1,61 @@
+// Copyright © 2018 Pierre Poissinger <pierre.poissinger@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pijalu/kitchensink/tool/socks"
+	"github.com/spf13/cobra"
+)
+
+var socksServer socks.Server
+
+// socksCmd represents the socks command
+var socksCmd = &cobra.Command{
+	Use:   "socks [bind.address]:port",
+	Short: "Start a SOCKS5 server",
+	Long:  `This command will start a SOCKS5 server supporting CONNECT and UDP ASSOCIATE. Browsers and other tools can use it to reach any target through a single local port`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		socksServer.SourceAddr = &args[0]
+
+		var err error
+		if socksServer.ACL, err = accessList(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if err := socksServer.Run(signalContext()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(socksCmd)
+
+	socksServer = socks.Server{
+		QuietFlag:   &quietFlag,
+		DialTimeOut: socksCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
+		Username:    socksCmd.Flags().StringP("user", "u", "", "Username clients must authenticate with, no authentication if empty."),
+		Password:    socksCmd.Flags().StringP("password", "w", "", "Password clients must authenticate with."),
+	}
+	addACLFlags(socksCmd)
+}
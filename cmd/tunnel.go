@@ -16,6 +16,8 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/pijalu/kitchensink/tool/tunnel"
@@ -35,7 +37,17 @@ var tunnelCmd = &cobra.Command{
 		tunnelConfig.SSHAddr = &args[1]
 		tunnelConfig.TargetAddr = &args[2]
 
-		tunnelConfig.Run()
+		var err error
+		if tunnelConfig.ACL, err = accessList(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		serveMetrics(metricsAddr)
+		if err := tunnelConfig.Run(signalContext()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -43,13 +55,16 @@ func init() {
 	rootCmd.AddCommand(tunnelCmd)
 
 	tunnelConfig = tunnel.Config{
-		Protocol:    tunnelCmd.Flags().StringP("protocol", "p", "tcp", "Protocol: tcp or udp."),
-		DialTimeOut: tunnelCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
-		QuietFlag:   &quietFlag,
-		RemoteCmd:   tunnelCmd.Flags().StringP("cmd", "c", "vmstat 5", "Remote command to run on ssh host."),
-		Username:    tunnelCmd.Flags().StringP("user", "u", "", "Username to use for remote connection."),
-		Password:    tunnelCmd.Flags().StringP("password", "w", "", "Password to use for authentication."),
-		KeyFile:     tunnelCmd.Flags().StringP("keyfile", "k", "", "Private key file to use."),
-		Force:       tunnelCmd.Flags().BoolP("force", "f", false, "Keep trying to connect to ssh host even if down."),
+		Protocol:     tunnelCmd.Flags().StringP("protocol", "p", "tcp", "Protocol: tcp or udp."),
+		DialTimeOut:  tunnelCmd.Flags().DurationP("timeout", "t", 30*time.Second, "Timeout for connect."),
+		QuietFlag:    &quietFlag,
+		RemoteCmd:    tunnelCmd.Flags().StringP("cmd", "c", "vmstat 5", "Remote command to run on ssh host."),
+		Username:     tunnelCmd.Flags().StringP("user", "u", "", "Username to use for remote connection."),
+		Password:     tunnelCmd.Flags().StringP("password", "w", "", "Password to use for authentication."),
+		KeyFile:      tunnelCmd.Flags().StringP("keyfile", "k", "", "Private key file to use."),
+		Force:        tunnelCmd.Flags().BoolP("force", "f", false, "Keep trying to connect to ssh host even if down."),
+		DrainTimeout: tunnelCmd.Flags().Duration("drain-timeout", 10*time.Second, "Time given to open tunnels to finish on shutdown."),
 	}
+	addACLFlags(tunnelCmd)
+	tunnelCmd.Flags().StringVar(&metricsAddr, "metrics-listen", "", "Listen address of the prometheus /metrics endpoint, disabled if empty.")
 }
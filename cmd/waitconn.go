@@ -16,6 +16,9 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/pijalu/kitchensink/tool/waitconn"
@@ -32,7 +35,10 @@ var waitconnCmd = &cobra.Command{
 	Long:  `waitcon will try to open a connection and retry every given delay (1sec by default)`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		waitConn.Addr(&args[0]).Run()
+		if err := waitConn.Addr(&args[0]).Run(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
 	},
 }
 
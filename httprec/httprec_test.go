@@ -0,0 +1,28 @@
+package httprec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := New(w)
+	if rec.Status != http.StatusOK {
+		t.Fatalf("Expected default status 200 but got %d", rec.Status)
+	}
+
+	rec.WriteHeader(http.StatusNotFound)
+	rec.Write([]byte("Hello"))
+	rec.Flush()
+	if rec.Status != http.StatusNotFound || rec.Size != 5 {
+		t.Fatalf("Expected 404 and 5 bytes but got %d and %d", rec.Status, rec.Size)
+	}
+	if !w.Flushed {
+		t.Fatal("Expected flush to reach the response writer")
+	}
+	if _, _, err := rec.Hijack(); err == nil {
+		t.Fatal("Expected hijack of a recorder to fail")
+	}
+}
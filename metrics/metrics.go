@@ -0,0 +1,307 @@
+// Package metrics implements counters, gauges and histograms exposed in the Prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics
+type Registry struct {
+	m       sync.Mutex
+	metrics map[string]*vec
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*vec),
+	}
+}
+
+// Default is the registry used by NewCounter, NewGauge and NewHistogram
+var Default = NewRegistry()
+
+func (r *Registry) register(v *vec) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if _, ok := r.metrics[v.name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", v.name))
+	}
+	r.metrics[v.name] = v
+}
+
+// WriteTo writes all metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.m.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*vec, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.m.Unlock()
+
+	var buf bytes.Buffer
+	for _, v := range metrics {
+		v.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler returns a http handler serving the registry metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteTo(w)
+	})
+}
+
+// Handler returns a http handler serving the default registry metrics
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// sample is the value of a metric for a set of label values
+type sample struct {
+	labels []string
+	value  float64
+	// histogram only
+	counts []uint64
+	count  uint64
+}
+
+// vec is a metric with labels
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	m       sync.Mutex
+	samples map[string]*sample
+}
+
+func newVec(r *Registry, kind string, name string, help string, labels []string, buckets []float64) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		samples: make(map[string]*sample),
+	}
+	r.register(v)
+	return v
+}
+
+// sample returns the sample of label values, the caller must hold the lock
+func (v *vec) sample(values []string) *sample {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), values...)}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.samples[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(delta float64, values []string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.sample(values).value += delta
+}
+
+func (v *vec) set(value float64, values []string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.sample(values).value = value
+}
+
+// escape escapes a label value
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// labelString formats label names and values, with extra pairs appended
+func labelString(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (v *vec) write(buf *bytes.Buffer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", v.name, v.kind)
+
+	// Metrics without labels always have a value
+	if len(v.labels) == 0 {
+		v.sample(nil)
+	}
+
+	keys := make([]string, 0, len(v.samples))
+	for key := range v.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.samples[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", v.name, labelString(v.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.labels, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, labelString(v.labels, s.labels), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", v.name, labelString(v.labels, s.labels), s.count)
+	}
+}
+
+// Counter is a metric that only goes up
+type Counter struct {
+	v *vec
+}
+
+// NewCounter registers a counter in the default registry
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter registers a counter
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{v: newVec(r, "counter", name, help, labels, nil)}
+}
+
+// Inc adds one to the counter of label values
+func (c *Counter) Inc(values ...string) {
+	c.v.add(1, values)
+}
+
+// Add adds delta, which must be positive, to the counter of label values
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	c.v.add(delta, values)
+}
+
+// Gauge is a metric that goes up and down
+type Gauge struct {
+	v *vec
+}
+
+// NewGauge registers a gauge in the default registry
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge registers a gauge
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{v: newVec(r, "gauge", name, help, labels, nil)}
+}
+
+// Set sets the gauge of label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.v.set(value, values)
+}
+
+// Add adds delta to the gauge of label values
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.v.add(delta, values)
+}
+
+// Inc adds one to the gauge of label values
+func (g *Gauge) Inc(values ...string) {
+	g.v.add(1, values)
+}
+
+// Dec removes one from the gauge of label values
+func (g *Gauge) Dec(values ...string) {
+	g.v.add(-1, values)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	v *vec
+}
+
+// NewHistogram registers a histogram in the default registry, using DefBuckets if buckets is nil
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram registers a histogram, using DefBuckets if buckets is nil
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Histogram{v: newVec(r, "histogram", name, help, labels, buckets)}
+}
+
+// Observe adds an observation to the histogram of label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.v.m.Lock()
+	defer h.v.m.Unlock()
+
+	s := h.v.sample(values)
+	s.value += value
+	s.count++
+	for i, bound := range h.v.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("test_requests_total", "Requests.", "code")
+	gauge := r.NewGauge("test_active", "Active.")
+	histogram := r.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1}, "target")
+
+	counter.Inc("200")
+	counter.Add(2, "200")
+	counter.Add(-1, "200")
+	counter.Inc(`5"0\0`)
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_active Active.
+# TYPE test_active gauge
+test_active 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{target="a",le="0.1"} 1
+test_duration_seconds_bucket{target="a",le="1"} 2
+test_duration_seconds_bucket{target="a",le="+Inf"} 3
+test_duration_seconds_sum{target="a"} 5.55
+test_duration_seconds_count{target="a"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="5\"0\\0"} 1
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("Expected\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a panic")
+		}
+	}()
+	NewRegistry().NewCounter("test_total", "Test.", "code").Inc()
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a panic")
+		}
+	}()
+	r := NewRegistry()
+	r.NewGauge("test", "Test.")
+	r.NewGauge("test", "Test.")
+}
+
+func TestEmptyVec(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.", "code")
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	if strings.Contains(buf.String(), "test_total{") {
+		t.Fatalf("Expected no sample but got\n%s", buf.String())
+	}
+}
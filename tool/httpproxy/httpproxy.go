@@ -0,0 +1,302 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pijalu/kitchensink/acl"
+	"github.com/pijalu/kitchensink/httprec"
+	"github.com/pijalu/kitchensink/quietlog"
+	"github.com/pijalu/kitchensink/tool/proxy"
+)
+
+// hopHeaders are removed from forwarded requests and responses (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Server is a HTTP/1.1 forward proxy
+type Server struct {
+	QuietFlag  *bool
+	SourceAddr *string
+	// Username and Password require clients to use basic proxy authentication, no authentication if Username is empty
+	Username *string
+	Password *string
+	// AllowedHosts restricts the hosts clients can reach, everything if empty.
+	// A pattern starting with a dot also matches subdomains.
+	AllowedHosts []string
+	DialTimeOut  *time.Duration
+	// AccessLog receives a line per request, disabled if nil
+	AccessLog io.Writer
+	// ACL filters clients by ip, nil to allow everyone
+	ACL *acl.List
+	Log *quietlog.QuietLogger
+
+	listener  net.Listener
+	transport *http.Transport
+}
+
+// Quiet returns true if the tool should keep being quiet
+func (s *Server) Quiet() bool {
+	return (s.QuietFlag != nil) && *s.QuietFlag
+}
+
+func (s *Server) log() *quietlog.QuietLogger {
+	if s.Log == nil {
+		s.Log = quietlog.DefaultLogger(s)
+	}
+	return s.Log
+}
+
+func (s *Server) dialer() *net.Dialer {
+	dialer := &net.Dialer{}
+	if s.DialTimeOut != nil {
+		dialer.Timeout = *s.DialTimeOut
+	}
+	return dialer
+}
+
+// allowedHost returns true if clients can reach host
+func (s *Server) allowedHost(host string) bool {
+	if len(s.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range s.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || host == strings.TrimPrefix(pattern, ".") {
+			return true
+		}
+		if strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized checks the basic proxy authentication of r
+func (s *Server) authorized(r *http.Request) (string, bool) {
+	if s.Username == nil || *s.Username == "" {
+		return "", true
+	}
+
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", false
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return "", false
+	}
+
+	ok := subtle.ConstantTimeCompare([]byte(credentials[0]), []byte(*s.Username)) == 1
+	ok = subtle.ConstantTimeCompare([]byte(credentials[1]), []byte(*s.Password)) == 1 && ok
+	return credentials[0], ok
+}
+
+// Listen binds the server source address. Use Addr to get the bound address.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", *s.SourceAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.log().Printf("Listening on %s", listener.Addr())
+	return nil
+}
+
+// Addr returns the bound address, or nil if the server is not listening
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve proxies requests until ctx is done. Listen must be called first.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.listener == nil {
+		return errors.New("http proxy is not listening")
+	}
+
+	s.transport = &http.Transport{
+		DialContext:         s.dialer().DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	defer s.transport.CloseIdleConnections()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveHTTP(ctx, w, r)
+		}),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	err := srv.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Run listens and proxies requests until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(ctx)
+}
+
+func (s *Server) serveHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	rec := httprec.New(w)
+	user := "-"
+	defer func() {
+		if s.AccessLog != nil {
+			fmt.Fprintf(s.AccessLog, "%s %s [%s] \"%s %s %s\" %d %d %s\n",
+				r.RemoteAddr,
+				user,
+				started.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method,
+				r.RequestURI,
+				r.Proto,
+				rec.Status,
+				rec.Size,
+				time.Since(started))
+		}
+	}()
+
+	if !s.ACL.AllowedAddr(r.RemoteAddr) {
+		http.Error(rec, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	name, ok := s.authorized(r)
+	if !ok {
+		rec.Header().Set("Proxy-Authenticate", `Basic realm="kitchensink"`)
+		http.Error(rec, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if name != "" {
+		user = name
+	}
+
+	if r.Method == http.MethodConnect {
+		s.connect(ctx, rec, r)
+		return
+	}
+
+	if !r.URL.IsAbs() || (r.URL.Scheme != "http" && r.URL.Scheme != "https") {
+		http.Error(rec, "this is a proxy, requests must use an absolute http URI", http.StatusBadRequest)
+		return
+	}
+	if !s.allowedHost(r.URL.Hostname()) {
+		http.Error(rec, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	s.forward(rec, r)
+}
+
+// removeHopHeaders removes hop-by-hop headers, including the ones listed in Connection
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forward sends a plain request to its target and copies back the response
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) {
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	out.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		out.Header[name] = append([]string(nil), values...)
+	}
+	removeHopHeaders(out.Header)
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	resp, err := s.transport.RoundTrip(out)
+	if err != nil {
+		s.log().Printf("Failed to forward %s %s for %s: %v", r.Method, r.URL, r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		s.log().Printf("Error during copy of %s for %s: %v", r.URL, r.RemoteAddr, err)
+	}
+}
+
+// connect opens a CONNECT tunnel
+func (s *Server) connect(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "CONNECT requires a host:port", http.StatusBadRequest)
+		return
+	}
+	if !s.allowedHost(host) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	target, err := s.dialer().DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		s.log().Printf("Failed to connect %s to %s: %v", r.RemoteAddr, r.Host, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		s.log().Printf("Failed to hijack connection of %s: %v", r.RemoteAddr, err)
+		target.Close()
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+
+	s.log().Printf("Opening tunnel to %s for %s", r.Host, r.RemoteAddr)
+	proxy.JoinBuffered(ctx, conn, rw.Reader, target, s.log())
+	s.log().Printf("Closing tunnel to %s for %s", r.Host, r.RemoteAddr)
+}
@@ -0,0 +1,183 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer safe for concurrent use
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.b.String()
+}
+
+// testServer starts a server, stopped by the returned function
+func testServer(t *testing.T, s *Server) func() {
+	quiet := true
+	source := "127.0.0.1:0"
+	timeout := time.Second
+	s.QuietFlag = &quiet
+	s.SourceAddr = &source
+	s.DialTimeOut = &timeout
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx)
+	}()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// client returns a http client using the proxy
+func client(s *Server, user string) *http.Client {
+	proxy := &url.URL{Scheme: "http", Host: s.Addr().String()}
+	if user != "" {
+		proxy.User = url.UserPassword(user, "secret")
+	}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+		Timeout:   2 * time.Second,
+	}
+}
+
+func TestForward(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("hop-by-hop header should not be forwarded")
+		}
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer target.Close()
+
+	accessLog := &syncBuffer{}
+	s := &Server{AccessLog: accessLog}
+	defer testServer(t, s)()
+
+	resp, err := client(s, "").Get(target.URL + "/world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /world" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if !strings.Contains(accessLog.String(), fmt.Sprintf("\"GET %s/world HTTP/1.1\" 200 12", target.URL)) {
+		t.Fatalf("unexpected access log %q", accessLog.String())
+	}
+}
+
+func TestConnect(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	defer target.Close()
+
+	s := &Server{}
+	defer testServer(t, s)()
+
+	c := client(s, "")
+	c.Transport.(*http.Transport).TLSClientConfig = target.Client().Transport.(*http.Transport).TLSClientConfig
+	resp, err := c.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("proxy credentials should not be forwarded")
+		}
+	}))
+	defer target.Close()
+
+	user, password := "user", "secret"
+	s := &Server{Username: &user, Password: &password}
+	defer testServer(t, s)()
+
+	for _, tc := range []struct {
+		user     string
+		expected int
+	}{
+		{"", http.StatusProxyAuthRequired},
+		{"other", http.StatusProxyAuthRequired},
+		{"user", http.StatusOK},
+	} {
+		resp, err := client(s, tc.user).Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("user %q: expected %d, got %d", tc.user, tc.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	s := &Server{AllowedHosts: []string{"example.com", ".example.org"}}
+	for host, expected := range map[string]bool{
+		"example.com":     true,
+		"www.example.com": false,
+		"EXAMPLE.ORG":     true,
+		"www.example.org": true,
+		"badexample.org":  false,
+	} {
+		if s.allowedHost(host) != expected {
+			t.Errorf("%s: expected allowed %v", host, expected)
+		}
+	}
+
+	defer testServer(t, s)()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addrSchemes are the networks an address can select with a "scheme://" prefix
+var addrSchemes = map[string]bool{
+	"tcp":  true,
+	"tcp4": true,
+	"tcp6": true,
+	"unix": true,
+}
+
+// splitAddr returns the network and address of a "scheme://address" address.
+// Addresses without scheme use the proxy protocol.
+func (proxy *Proxy) splitAddr(addr string) (string, string, error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return *proxy.Protocol, addr, nil
+	}
+	network := strings.ToLower(addr[:i])
+	if !addrSchemes[network] {
+		return "", "", fmt.Errorf("unknown scheme %q in %s, expected tcp, tcp4, tcp6 or unix", network, addr)
+	}
+	if proxy.udp() {
+		return "", "", fmt.Errorf("address scheme of %s is not supported over udp", addr)
+	}
+	if addr[i+3:] == "" {
+		return "", "", fmt.Errorf("missing address in %s", addr)
+	}
+	return network, addr[i+3:], nil
+}
+
+// label describes an address with its network for logs
+func (proxy *Proxy) label(addr string) string {
+	network, address, err := proxy.splitAddr(addr)
+	if err != nil {
+		return addr
+	}
+	return address + "/" + network
+}
+
+// checkAddrs validates the scheme of all target addresses
+func (proxy *Proxy) checkAddrs() error {
+	addrs := append([]string(nil), proxy.TargetAddrs...)
+	for _, forward := range proxy.Forwards {
+		addrs = append(addrs, forward.Targets...)
+	}
+	for _, route := range proxy.SNIRoutes {
+		if parts := strings.SplitN(route, "=", 2); len(parts) == 2 {
+			addrs = append(addrs, parts[1])
+		}
+	}
+	if set(proxy.Mirror) {
+		addrs = append(addrs, *proxy.Mirror)
+	}
+	for _, addr := range addrs {
+		if _, _, err := proxy.splitAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socketMode returns the permissions of the listening unix socket, or 0 to keep the default ones
+func (proxy *Proxy) socketMode() (os.FileMode, error) {
+	if !set(proxy.SocketMode) {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(*proxy.SocketMode, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q, expected octal permissions like 0660", *proxy.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenUnix listens on a unix socket, replacing a stale socket file and applying the socket mode.
+// The socket file is removed when the listener is closed.
+func (proxy *Proxy) listenUnix(path string) (net.Listener, error) {
+	mode, err := proxy.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 && !abstractSocket(path) {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// abstractSocket returns true for linux abstract sockets, which have no file
+func abstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run.
+// It fails if the socket still accepts connections or if the file is not a socket.
+func removeStaleSocket(path string) error {
+	if abstractSocket(path) {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return errors.New("socket " + path + " is in use")
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAddr(t *testing.T) {
+	proxy := testProxy("")
+	for addr, expected := range map[string][2]string{
+		"127.0.0.1:80":                {"tcp", "127.0.0.1:80"},
+		"tcp://0.0.0.0:2375":          {"tcp", "0.0.0.0:2375"},
+		"TCP6://[::1]:80":             {"tcp6", "[::1]:80"},
+		"unix:///var/run/docker.sock": {"unix", "/var/run/docker.sock"},
+	} {
+		network, address, err := proxy.splitAddr(addr)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if network != expected[0] || address != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s", addr, expected, network, address)
+		}
+	}
+
+	for _, addr := range []string{"udp://127.0.0.1:53", "unix://", "http://localhost:80"} {
+		if _, _, err := proxy.splitAddr(addr); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+
+	protocol := "udp"
+	proxy.Protocol = &protocol
+	if _, _, err := proxy.splitAddr("tcp://127.0.0.1:53"); err == nil {
+		t.Error("expected error for a scheme over udp")
+	}
+}
+
+// unixEcho starts an echo server on a unix socket
+func unixEcho(t *testing.T, path string) net.Listener {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestUnixTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	echo := unixEcho(t, filepath.Join(dir, "echo.sock"))
+	defer echo.Close()
+
+	proxy := testProxy("unix://" + echo.Addr().String())
+	source := "tcp://127.0.0.1:0"
+	proxy.SourceAddr = &source
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	echoThrough(t, proxy, []byte("Hello World"))
+}
+
+func TestUnixSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	// A stale socket file is replaced
+	path := filepath.Join(dir, "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	source := "unix://" + path
+	mode := "0600"
+	proxy.SourceAddr = &source
+	proxy.SocketMode = &mode
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- proxy.Serve(ctx)
+	}()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("Expected socket mode 0600 but got %o", perm)
+	}
+
+	// A socket in use is kept
+	other := testProxy(echo.Addr().String())
+	other.SourceAddr = &source
+	if err := other.Listen(); err == nil {
+		t.Fatal("Expected error listening on a socket in use")
+	}
+
+	echoThrough(t, proxy, []byte("Hello World"))
+
+	cancel()
+	<-done
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket file to be removed, got %v", err)
+	}
+}
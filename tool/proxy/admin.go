@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connectionInfo describes an active connection in the admin api
+type connectionInfo struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Started  time.Time `json:"started"`
+	Age      string    `json:"age"`
+}
+
+// targetInfo describes a target in the admin api
+type targetInfo struct {
+	Addr        string `json:"addr"`
+	Connections int64  `json:"connections"`
+	Healthy     bool   `json:"healthy"`
+}
+
+// impairmentInfo is the admin api representation of an Impairment
+type impairmentInfo struct {
+	Latency          string  `json:"latency"`
+	Jitter           string  `json:"jitter"`
+	RateUp           int64   `json:"rate_up"`
+	RateDown         int64   `json:"rate_down"`
+	ResetProbability float64 `json:"reset_probability"`
+	StallProbability float64 `json:"stall_probability"`
+	StallDuration    string  `json:"stall_duration"`
+}
+
+func newImpairmentInfo(i Impairment) impairmentInfo {
+	return impairmentInfo{
+		Latency:          i.Latency.String(),
+		Jitter:           i.Jitter.String(),
+		RateUp:           i.RateUp,
+		RateDown:         i.RateDown,
+		ResetProbability: i.ResetProbability,
+		StallProbability: i.StallProbability,
+		StallDuration:    i.StallDuration.String(),
+	}
+}
+
+func (info impairmentInfo) impairment() (Impairment, error) {
+	i := Impairment{
+		RateUp:           info.RateUp,
+		RateDown:         info.RateDown,
+		ResetProbability: info.ResetProbability,
+		StallProbability: info.StallProbability,
+	}
+	for _, d := range []struct {
+		value string
+		field *time.Duration
+	}{
+		{info.Latency, &i.Latency},
+		{info.Jitter, &i.Jitter},
+		{info.StallDuration, &i.StallDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return i, err
+		}
+		*d.field = parsed
+	}
+	return i, i.Validate()
+}
+
+// track registers an active request
+func (proxy *Proxy) track(r *proxyRequest) {
+	proxy.rm.Lock()
+	defer proxy.rm.Unlock()
+
+	if proxy.requests == nil {
+		proxy.requests = make(map[uint64]*proxyRequest)
+	}
+	proxy.requests[r.id] = r
+}
+
+// untrack forgets a closed request
+func (proxy *Proxy) untrack(r *proxyRequest) {
+	proxy.rm.Lock()
+	defer proxy.rm.Unlock()
+
+	delete(proxy.requests, r.id)
+}
+
+// connections returns the active connections, oldest first
+func (proxy *Proxy) connections() []connectionInfo {
+	proxy.rm.Lock()
+	defer proxy.rm.Unlock()
+
+	now := time.Now()
+	infos := make([]connectionInfo, 0, len(proxy.requests))
+	for _, r := range proxy.requests {
+		infos = append(infos, connectionInfo{
+			ID:       r.id,
+			Client:   r.client.RemoteAddr().String(),
+			Target:   r.target,
+			BytesIn:  atomic.LoadInt64(&r.offset[toTarget]),
+			BytesOut: atomic.LoadInt64(&r.offset[toClient]),
+			Started:  r.started,
+			Age:      now.Sub(r.started).String(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Kill closes an active connection, returning false if it does not exist
+func (proxy *Proxy) Kill(id uint64) bool {
+	proxy.rm.Lock()
+	r, ok := proxy.requests[id]
+	proxy.rm.Unlock()
+
+	if ok {
+		proxy.log().Printf("Killing connection #%d", id)
+		r.cancel()
+	}
+	return ok
+}
+
+// SetTargets replaces the targets used by new connections
+func (proxy *Proxy) SetTargets(addrs []string) error {
+	if len(addrs) == 0 {
+		return errNoUpstream
+	}
+	for _, addr := range addrs {
+		if _, _, err := proxy.splitAddr(addr); err != nil {
+			return err
+		}
+	}
+	upstreams, err := proxy.upstreams()
+	if err != nil {
+		return err
+	}
+
+	proxy.log().Printf("Changing targets to %s", strings.Join(addrs, ", "))
+	upstreams.set(addrs)
+	return nil
+}
+
+func (proxy *Proxy) targets() []targetInfo {
+	upstreams, err := proxy.upstreams()
+	if err != nil {
+		return nil
+	}
+
+	var infos []targetInfo
+	for _, u := range upstreams.list() {
+		infos = append(infos, targetInfo{
+			Addr:        u.addr,
+			Connections: u.connections(),
+			Healthy:     u.healthy(),
+		})
+	}
+	return infos
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// AdminHandler returns the http handler of the admin api:
+//
+//	GET    /connections       list active connections
+//	DELETE /connections/{id}  kill a connection
+//	GET    /targets           list targets
+//	PUT    /targets           replace targets with a json list of addresses
+//	GET    /impairment        show the impairment settings
+//	PUT    /impairment        change the impairment settings
+func (proxy *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, proxy.connections())
+	})
+
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection id: %v", err))
+			return
+		}
+		if !proxy.Kill(id) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no connection #%d", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var addrs []string
+			if err := json.NewDecoder(r.Body).Decode(&addrs); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := proxy.SetTargets(addrs); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, proxy.targets())
+	})
+
+	mux.HandleFunc("/impairment", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			// Unset fields keep their current value
+			info := newImpairmentInfo(proxy.CurrentImpairment())
+			if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			i, err := info.impairment()
+			if err == nil {
+				err = proxy.SetImpairment(i)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			proxy.log().Printf("Changing impairment to %+v", i)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, newImpairmentInfo(proxy.CurrentImpairment()))
+	})
+
+	return mux
+}
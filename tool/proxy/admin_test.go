@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method string, path string, body string, value interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if value != nil {
+		if err := json.NewDecoder(w.Body).Decode(value); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminConnections(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("Hello"))
+	io.ReadFull(conn, make([]byte, 5))
+
+	handler := proxy.AdminHandler()
+	var connections []connectionInfo
+	adminRequest(t, handler, http.MethodGet, "/connections", "", &connections)
+	if len(connections) != 1 {
+		t.Fatalf("Expected 1 connection but got %d", len(connections))
+	}
+	if c := connections[0]; c.BytesIn != 5 || c.BytesOut != 5 || c.Client != conn.LocalAddr().String() {
+		t.Fatalf("Unexpected connection %+v", c)
+	}
+
+	if code := adminRequest(t, handler, http.MethodDelete, "/connections/999", "", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected not found but got %d", code)
+	}
+	if code := adminRequest(t, handler, http.MethodDelete, "/connections/1", "", nil); code != http.StatusNoContent {
+		t.Fatalf("Expected no content but got %d", code)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected killed connection to be closed")
+	}
+}
+
+func TestAdminTargets(t *testing.T) {
+	proxy := testProxy("127.0.0.1:1")
+	handler := proxy.AdminHandler()
+
+	var targets []targetInfo
+	if code := adminRequest(t, handler, http.MethodPut, "/targets", `["127.0.0.1:2","127.0.0.1:3"]`, &targets); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %d", code)
+	}
+	if len(targets) != 2 || targets[0].Addr != "127.0.0.1:2" || !targets[0].Healthy {
+		t.Fatalf("Unexpected targets %+v", targets)
+	}
+
+	if code := adminRequest(t, handler, http.MethodPut, "/targets", `[]`, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request but got %d", code)
+	}
+	if code := adminRequest(t, handler, http.MethodPut, "/targets", `["ftp://127.0.0.1:2"]`, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request but got %d", code)
+	}
+}
+
+func TestAdminImpairment(t *testing.T) {
+	proxy := testProxy("127.0.0.1:1")
+	proxy.Impairment = &Impairment{RateUp: 1000}
+	handler := proxy.AdminHandler()
+
+	var info impairmentInfo
+	if code := adminRequest(t, handler, http.MethodPut, "/impairment", `{"latency":"150ms"}`, &info); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %d", code)
+	}
+	if info.Latency != "150ms" || info.RateUp != 1000 {
+		t.Fatalf("Unexpected impairment %+v", info)
+	}
+	if proxy.CurrentImpairment().Latency != 150*time.Millisecond {
+		t.Fatal("Expected impairment to be changed")
+	}
+
+	for _, body := range []string{`{"latency":"soon"}`, `{"reset_probability":2}`} {
+		if code := adminRequest(t, handler, http.MethodPut, "/impairment", body, nil); code != http.StatusBadRequest {
+			t.Fatalf("Expected bad request for %s but got %d", body, code)
+		}
+	}
+}
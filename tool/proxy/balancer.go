@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing strategies
+const (
+	// RoundRobin picks targets in turn
+	RoundRobin = "roundrobin"
+	// LeastConn picks the target with the least active connections
+	LeastConn = "leastconn"
+	// Random picks a random target
+	Random = "random"
+	// SourceHash always picks the same target for a given client ip
+	SourceHash = "sourcehash"
+)
+
+// errNoUpstream is returned when no target can be tried
+var errNoUpstream = errors.New("no upstream available")
+
+// errCircuitOpen is returned when all targets have their circuit breaker open
+var errCircuitOpen = errors.New("circuit breaker open for all targets")
+
+// upstream is a proxy target
+type upstream struct {
+	// active is the number of open connections (atomic)
+	active int64
+
+	addr string
+
+	// health check state
+	hm    sync.Mutex
+	down  bool
+	rises int
+	fails int
+
+	// circuit breaker state
+	dialFails int
+	openUntil time.Time
+}
+
+func (u *upstream) acquire() {
+	atomic.AddInt64(&u.active, 1)
+}
+
+func (u *upstream) release() {
+	atomic.AddInt64(&u.active, -1)
+}
+
+func (u *upstream) connections() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// pool selects upstreams for new connections
+type pool struct {
+	// next is the round robin counter (atomic)
+	next uint64
+
+	strategy string
+
+	m         sync.RWMutex
+	upstreams []*upstream
+
+	rm   sync.Mutex
+	rand *rand.Rand
+}
+
+func newPool(strategy string, addrs []string) (*pool, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastConn, Random, SourceHash:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %s", strategy)
+	}
+
+	p := &pool{
+		strategy: strategy,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	p.set(addrs)
+	return p, nil
+}
+
+// set replaces the upstreams of the pool. Addresses already in the pool keep their
+// upstream, with its connections, health and circuit breaker state.
+func (p *pool) set(addrs []string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	current := make(map[string]*upstream, len(p.upstreams))
+	for _, u := range p.upstreams {
+		current[u.addr] = u
+	}
+
+	upstreams := make([]*upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		u, ok := current[addr]
+		if ok {
+			delete(current, addr)
+		} else {
+			u = &upstream{addr: addr}
+		}
+		upstreams = append(upstreams, u)
+	}
+	p.upstreams = upstreams
+}
+
+// list returns the current upstreams
+func (p *pool) list() []*upstream {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	return append([]*upstream(nil), p.upstreams...)
+}
+
+// rotate returns upstreams starting at offset start
+func rotate(upstreams []*upstream, start int) []*upstream {
+	start = start % len(upstreams)
+	return append(upstreams[start:], upstreams[:start]...)
+}
+
+// sourceHash hashes the ip part of a client address
+func sourceHash(client net.Addr) uint32 {
+	key := ""
+	if client != nil {
+		key = client.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// available returns the upstreams in rotation, or all of them if none is healthy
+func (p *pool) available() []*upstream {
+	upstreams := p.list()
+
+	healthy := make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
+
+// candidates returns the upstreams in the order they should be tried for client
+func (p *pool) candidates(client net.Addr) []*upstream {
+	upstreams := p.available()
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+
+	switch p.strategy {
+	case LeastConn:
+		upstreams = rotate(upstreams, int(atomic.AddUint64(&p.next, 1)-1))
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].connections() < upstreams[j].connections()
+		})
+		return upstreams
+	case Random:
+		p.rm.Lock()
+		defer p.rm.Unlock()
+		shuffled := make([]*upstream, len(upstreams))
+		for i, j := range p.rand.Perm(len(upstreams)) {
+			shuffled[i] = upstreams[j]
+		}
+		return shuffled
+	case SourceHash:
+		return rotate(upstreams, int(sourceHash(client)%uint32(len(upstreams))))
+	default:
+		return rotate(upstreams, int(atomic.AddUint64(&p.next, 1)-1))
+	}
+}
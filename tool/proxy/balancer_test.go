@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolUnknownStrategy(t *testing.T) {
+	if _, err := newPool("fastest", []string{"a:1"}); err == nil {
+		t.Fatal("Expected an error for unknown strategy")
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p, err := newPool(RoundRobin, []string{"a:1", "b:1", "c:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"a:1", "b:1", "c:1", "a:1"} {
+		candidates := p.candidates(nil)
+		if len(candidates) != 3 {
+			t.Fatalf("Expected 3 candidates but got %d", len(candidates))
+		}
+		if actual := candidates[0].addr; actual != expected {
+			t.Fatalf("Expected %s but got %s", expected, actual)
+		}
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	p, err := newPool(LeastConn, []string{"a:1", "b:1", "c:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := p.list()
+	upstreams[0].acquire()
+	upstreams[2].acquire()
+
+	for i := 0; i < 3; i++ {
+		if actual := p.candidates(nil)[0].addr; actual != "b:1" {
+			t.Fatalf("Expected b:1 but got %s", actual)
+		}
+	}
+}
+
+func TestPoolSet(t *testing.T) {
+	p, err := newPool(LeastConn, []string{"a:1", "b:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := p.list()[1]
+	kept.acquire()
+
+	p.set([]string{"b:1", "c:1"})
+	upstreams := p.list()
+	if len(upstreams) != 2 || upstreams[0] != kept || upstreams[1].addr != "c:1" {
+		t.Fatalf("Expected b:1 to be kept and c:1 to be added, got %+v", upstreams)
+	}
+	if kept.connections() != 1 {
+		t.Fatalf("Expected kept upstream to keep its connections, got %d", kept.connections())
+	}
+}
+
+func TestPoolSourceHash(t *testing.T) {
+	p, err := newPool(SourceHash, []string{"a:1", "b:1", "c:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	second := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	if p.candidates(first)[0] != p.candidates(second)[0] {
+		t.Fatal("Expected the same target for the same source ip")
+	}
+}
+
+func TestPoolRandom(t *testing.T) {
+	p, err := newPool(Random, []string{"a:1", "b:1", "c:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range p.candidates(nil) {
+		seen[u.addr] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected all targets as candidates but got %v", seen)
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	u := &upstream{addr: "a:1"}
+	failure := errors.New("refused")
+
+	if u.dialed(failure, 2, time.Minute) || !u.allow(time.Now()) {
+		t.Fatal("Expected breaker to stay closed after one failure")
+	}
+	if !u.dialed(failure, 2, time.Minute) || u.allow(time.Now()) {
+		t.Fatal("Expected breaker to open after two failures")
+	}
+	if !u.allow(time.Now().Add(2 * time.Minute)) {
+		t.Fatal("Expected breaker to allow dial after cooldown")
+	}
+
+	u.dialed(nil, 2, time.Minute)
+	if u.dialed(failure, 2, time.Minute) {
+		t.Fatal("Expected success to reset the breaker")
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.Addr().String()
+	closed.Close()
+
+	quiet := true
+	protocol := "tcp"
+	timeout := time.Second
+	threshold := 1
+	proxy := &Proxy{
+		QuietFlag:        &quiet,
+		Protocol:         &protocol,
+		DialTimeOut:      &timeout,
+		TargetAddrs:      []string{dead, listener.Addr().String()},
+		BreakerThreshold: &threshold,
+	}
+
+	conn, target, err := proxy.dial(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target.addr != listener.Addr().String() {
+		t.Fatalf("Expected %s but got %s", listener.Addr(), target.addr)
+	}
+
+	// The dead target keeps the circuit opened by the first dial
+	proxy.pool.set([]string{dead})
+	if _, _, err := proxy.dial(context.Background(), nil, nil); err != errCircuitOpen {
+		t.Fatalf("Expected circuit to be open but got %v", err)
+	}
+
+	// A new dead target is dialled before its circuit opens
+	closed, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	proxy.pool.set([]string{dead, closed.Addr().String()})
+	if _, _, err := proxy.dial(context.Background(), nil, nil); err == nil || err == errCircuitOpen {
+		t.Fatalf("Expected dial error but got %v", err)
+	}
+}
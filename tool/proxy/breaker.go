@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"time"
+)
+
+// maxRetryBackoff caps the delay between two dial retries
+const maxRetryBackoff = 30 * time.Second
+
+// allow returns false while the circuit breaker of the upstream is open
+func (u *upstream) allow(now time.Time) bool {
+	u.hm.Lock()
+	defer u.hm.Unlock()
+
+	return !now.Before(u.openUntil)
+}
+
+// dialed records a dial result for the circuit breaker and returns true if the breaker opened.
+// The breaker opens for cooldown after threshold failures in a row, a threshold of 0 disables it.
+// Once the cooldown is over, a single failure opens it again.
+func (u *upstream) dialed(err error, threshold int, cooldown time.Duration) bool {
+	u.hm.Lock()
+	defer u.hm.Unlock()
+
+	if err == nil {
+		u.dialFails = 0
+		return false
+	}
+
+	u.dialFails++
+	if threshold <= 0 || u.dialFails < threshold {
+		return false
+	}
+	u.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+func (proxy *Proxy) breakerSettings() (int, time.Duration) {
+	threshold, cooldown := 0, 30*time.Second
+	if proxy.BreakerThreshold != nil {
+		threshold = *proxy.BreakerThreshold
+	}
+	if proxy.BreakerCooldown != nil && *proxy.BreakerCooldown > 0 {
+		cooldown = *proxy.BreakerCooldown
+	}
+	return threshold, cooldown
+}
+
+func (proxy *Proxy) retrySettings() (int, time.Duration) {
+	retries, backoff := 0, 500*time.Millisecond
+	if proxy.DialRetries != nil && *proxy.DialRetries > 0 {
+		retries = *proxy.DialRetries
+	}
+	if proxy.RetryBackoff != nil && *proxy.RetryBackoff > 0 {
+		backoff = *proxy.RetryBackoff
+	}
+	return retries, backoff
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcap file constants
+const (
+	pcapMagic   = 0xa1b2c3d4
+	pcapSnapLen = 65535
+	// pcapLinkTypeRaw is LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+	// pcapMaxSegment is the largest tcp payload of a synthesized packet
+	pcapMaxSegment = 32 * 1024
+)
+
+// tcp flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapWriter writes synthesized tcp/ip packets to a pcap file
+type pcapWriter struct {
+	m sync.Mutex
+	w *bufio.Writer
+	c io.Closer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	p := &pcapWriter{w: bufio.NewWriter(w)}
+	if c, ok := w.(io.Closer); ok {
+		p.c = c
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err := p.w.Write(header); err != nil {
+		return nil, err
+	}
+	return p, p.w.Flush()
+}
+
+// createPcap creates a pcap file
+func createPcap(file string) (*pcapWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPcapWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// write appends a packet record, the caller must hold the lock
+func (p *pcapWriter) write(ts time.Time, packet []byte) error {
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	if _, err := p.w.Write(record); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(packet); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+// Close flushes and closes the pcap file
+func (p *pcapWriter) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := p.w.Flush()
+	if p.c != nil {
+		if cerr := p.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// pcapStream synthesizes the packets of one proxied connection
+type pcapStream struct {
+	w *pcapWriter
+	// addresses and next sequence number, indexed by sending direction
+	ip   [2]net.IP
+	port [2]uint16
+	seq  [2]uint32
+}
+
+// captureAddr returns ip and port of a tcp address, or fallback ones for other addresses
+func captureAddr(addr net.Addr, fallback net.IP, port uint16) (net.IP, uint16) {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		return a.IP, uint16(a.Port)
+	}
+	return fallback, port
+}
+
+// stream starts the capture of a connection from client to server
+func (p *pcapWriter) stream(client net.Addr, server net.Addr) *pcapStream {
+	s := &pcapStream{
+		w:   p,
+		seq: [2]uint32{rand.Uint32(), rand.Uint32()},
+	}
+	s.ip[toTarget], s.port[toTarget] = captureAddr(client, net.IPv4(10, 0, 0, 1), uint16(1024+rand.Intn(60000)))
+	s.ip[toClient], s.port[toClient] = captureAddr(server, net.IPv4(10, 0, 0, 2), 80)
+
+	// Use the same ip version on both sides
+	if s.ip[toTarget].To4() == nil || s.ip[toClient].To4() == nil {
+		s.ip[toTarget] = s.ip[toTarget].To16()
+		s.ip[toClient] = s.ip[toClient].To16()
+	} else {
+		s.ip[toTarget] = s.ip[toTarget].To4()
+		s.ip[toClient] = s.ip[toClient].To4()
+	}
+
+	s.send(toTarget, tcpSYN, nil)
+	s.send(toClient, tcpSYN|tcpACK, nil)
+	s.send(toTarget, tcpACK, nil)
+	return s
+}
+
+// data records a chunk sent in a direction
+func (s *pcapStream) data(dir direction, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		s.send(dir, tcpPSH|tcpACK, b[:n])
+		b = b[n:]
+	}
+}
+
+// close records the connection shutdown
+func (s *pcapStream) close() {
+	s.send(toTarget, tcpFIN|tcpACK, nil)
+	s.send(toClient, tcpFIN|tcpACK, nil)
+	s.send(toTarget, tcpACK, nil)
+}
+
+// send writes one packet and advances the sequence number of its direction
+func (s *pcapStream) send(dir direction, flags byte, payload []byte) {
+	s.w.m.Lock()
+	defer s.w.m.Unlock()
+
+	src, dst := dir, dir.reverse()
+	ack := uint32(0)
+	if flags&tcpACK != 0 {
+		ack = s.seq[dst]
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], s.port[src])
+	binary.BigEndian.PutUint16(tcp[2:], s.port[dst])
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[src])
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var packet []byte
+	if len(s.ip[src]) == net.IPv4len {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[6:], 0x4000)
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], s.ip[src])
+		copy(packet[16:], s.ip[dst])
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], s.ip[src])
+		copy(pseudo[4:], s.ip[dst])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], s.ip[src])
+		copy(packet[24:], s.ip[dst])
+
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], s.ip[src])
+		copy(pseudo[16:], s.ip[dst])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	}
+	packet = append(packet, tcp...)
+
+	s.seq[src] += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		s.seq[src]++
+	}
+
+	// Capture is best effort, a failing write must not break the proxied connection
+	s.w.write(time.Now(), packet)
+}
+
+// sum adds b as big endian 16 bits words
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, starting from initial
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
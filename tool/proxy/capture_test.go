@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// readPcap returns the packets of a pcap file
+func readPcap(t *testing.T, b []byte) [][]byte {
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != pcapMagic {
+		t.Fatal("Invalid pcap header")
+	}
+	if binary.LittleEndian.Uint32(b[20:]) != pcapLinkTypeRaw {
+		t.Fatal("Invalid pcap link type")
+	}
+
+	var packets [][]byte
+	for b = b[24:]; len(b) > 0; {
+		size := binary.LittleEndian.Uint32(b[8:])
+		packets = append(packets, b[16:16+size])
+		b = b[16+size:]
+	}
+	return packets
+}
+
+func TestCapture(t *testing.T) {
+	for _, addrs := range [][2]string{
+		{"192.168.0.1:56324", "10.0.0.1:443"},
+		{"[2001:db8::1]:56324", "10.0.0.1:443"},
+	} {
+		client, _ := net.ResolveTCPAddr("tcp", addrs[0])
+		server, _ := net.ResolveTCPAddr("tcp", addrs[1])
+
+		var buf bytes.Buffer
+		w, err := newPcapWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := w.stream(client, server)
+		s.data(toTarget, []byte("ping"))
+		s.data(toClient, []byte("pong!"))
+		s.close()
+
+		packets := readPcap(t, buf.Bytes())
+		if len(packets) != 8 {
+			t.Fatalf("Expected 8 packets but got %d", len(packets))
+		}
+
+		expectedFlags := []byte{tcpSYN, tcpSYN | tcpACK, tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK, tcpFIN | tcpACK, tcpFIN | tcpACK, tcpACK}
+		for i, packet := range packets {
+			var tcp, pseudo []byte
+			if packet[0]>>4 == 4 {
+				if checksum(packet[:20], 0) != 0 {
+					t.Fatalf("Packet %d: invalid ip checksum", i)
+				}
+				tcp = packet[20:]
+				pseudo = append(append([]byte{}, packet[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+			} else {
+				tcp = packet[40:]
+				pseudo = append(append([]byte{}, packet[8:40]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+			}
+			if checksum(tcp, sum(pseudo)) != 0 {
+				t.Fatalf("Packet %d: invalid tcp checksum", i)
+			}
+			if tcp[13] != expectedFlags[i] {
+				t.Fatalf("Packet %d: expected flags %#x but got %#x", i, expectedFlags[i], tcp[13])
+			}
+		}
+
+		// Sequence numbers account for payloads
+		seq := func(i int) uint32 { return binary.BigEndian.Uint32(packets[i][headerLen(packets[i])+4:]) }
+		ack := func(i int) uint32 { return binary.BigEndian.Uint32(packets[i][headerLen(packets[i])+8:]) }
+		if seq(5) != seq(3)+4 || ack(6) != seq(5)+1 || seq(6) != seq(4)+5 {
+			t.Fatal("Invalid sequence numbers")
+		}
+	}
+}
+
+func headerLen(packet []byte) int {
+	if packet[0]>>4 == 4 {
+		return 20
+	}
+	return 40
+}
+
+func TestCaptureUDP(t *testing.T) {
+	proxy := testProxy("127.0.0.1:1")
+	protocol := "udp"
+	file := "capture.pcap"
+	proxy.Protocol = &protocol
+	proxy.CaptureFile = &file
+	if err := proxy.Listen(); err == nil {
+		proxy.closeListeners()
+		t.Fatal("Expected capture over udp to be rejected")
+	}
+}
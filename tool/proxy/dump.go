@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Dump modes
+const (
+	// DumpHex prints chunks as an hexdump
+	DumpHex = "hex"
+	// DumpText prints chunks as text, escaping non printable characters
+	DumpText = "text"
+	// DumpBoth prints chunks both as hexdump and text
+	DumpBoth = "both"
+)
+
+// dumper prints proxied chunks
+type dumper struct {
+	mode string
+	// max is the maximum number of bytes printed per chunk, 0 for no limit
+	max int
+
+	m sync.Mutex
+	w io.Writer
+}
+
+func newDumper(mode string, max int, w io.Writer) (*dumper, error) {
+	switch mode {
+	case DumpHex, DumpText, DumpBoth:
+	default:
+		return nil, fmt.Errorf("unknown dump mode %s", mode)
+	}
+	return &dumper{
+		mode: mode,
+		max:  max,
+		w:    w,
+	}, nil
+}
+
+// arrow returns the symbol of a direction
+func (d direction) arrow() string {
+	if d == toTarget {
+		return ">"
+	}
+	return "<"
+}
+
+// dump prints a chunk of connection id, read in a direction at offset
+func (d *dumper) dump(id uint64, dir direction, offset int64, chunk []byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s #%d offset=%d length=%d\n",
+		dir.arrow(),
+		time.Now().Format("2006/01/02 15:04:05.000000"),
+		id,
+		offset,
+		len(chunk))
+
+	truncated := 0
+	if d.max > 0 && len(chunk) > d.max {
+		truncated = len(chunk) - d.max
+		chunk = chunk[:d.max]
+	}
+
+	if d.mode == DumpHex || d.mode == DumpBoth {
+		hexdump(&buf, offset, chunk)
+	}
+	if d.mode == DumpText || d.mode == DumpBoth {
+		textdump(&buf, chunk)
+	}
+	if truncated > 0 {
+		fmt.Fprintf(&buf, "... %d more bytes\n", truncated)
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.w.Write(buf.Bytes())
+}
+
+// hexdump writes b as 16 bytes lines, prefixed by their stream offset
+func hexdump(buf *bytes.Buffer, offset int64, b []byte) {
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		fmt.Fprintf(buf, "%08x ", offset+int64(i))
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				buf.WriteByte(' ')
+			}
+			if j < len(line) {
+				fmt.Fprintf(buf, " %02x", line[j])
+			} else {
+				buf.WriteString("   ")
+			}
+		}
+
+		buf.WriteString("  |")
+		for _, c := range line {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteString("|\n")
+	}
+}
+
+// textdump writes b as text, escaping non printable characters but new lines
+func textdump(buf *bytes.Buffer, b []byte) {
+	for _, c := range b {
+		switch {
+		case c == '\n':
+			buf.WriteByte(c)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c < 32 || c > 126:
+			fmt.Fprintf(buf, `\x%02x`, c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	for _, testCase := range []struct {
+		mode     string
+		max      int
+		expected []string
+		missing  []string
+	}{
+		{DumpHex, 0, []string{
+			"> ", "#7 offset=16 length=20",
+			"00000010  48 65 6c 6c 6f 0d 0a 57  6f 72 6c 64 21 21 21 21  |Hello..World!!!!|",
+			"00000020  21 21 21 21",
+		}, []string{"Hello\\r"}},
+		{DumpText, 0, []string{"Hello\\r\nWorld!!!!!!!!\n"}, []string{"00000010"}},
+		{DumpBoth, 5, []string{"00000010  48 65 6c 6c 6f", "|Hello|", "Hello\n", "... 15 more bytes"}, []string{"World"}},
+	} {
+		var buf bytes.Buffer
+		d, err := newDumper(testCase.mode, testCase.max, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.dump(7, toTarget, 16, []byte("Hello\r\nWorld!!!!!!!!"))
+
+		output := buf.String()
+		for _, expected := range testCase.expected {
+			if !strings.Contains(output, expected) {
+				t.Fatalf("%s: expected %q in\n%s", testCase.mode, expected, output)
+			}
+		}
+		for _, missing := range testCase.missing {
+			if strings.Contains(output, missing) {
+				t.Fatalf("%s: unexpected %q in\n%s", testCase.mode, missing, output)
+			}
+		}
+	}
+}
+
+func TestDumpUnknownMode(t *testing.T) {
+	if _, err := newDumper("binary", 0, &bytes.Buffer{}); err == nil {
+		t.Fatal("Expected error for unknown mode")
+	}
+}
+
+func TestDumpUDP(t *testing.T) {
+	proxy := testProxy("127.0.0.1:1")
+	protocol := "udp"
+	mode := "hex"
+	proxy.Protocol = &protocol
+	proxy.Dump = &mode
+	if err := proxy.Listen(); err == nil {
+		proxy.closeListeners()
+		t.Fatal("Expected dump over udp to be rejected")
+	}
+}
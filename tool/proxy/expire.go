@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+func (r *proxyRequest) touch() {
+	atomic.StoreInt64(&r.lastSeen, time.Now().UnixNano())
+}
+
+func (r *proxyRequest) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastSeen)))
+}
+
+// timeouts returns the idle timeout and maximum lifetime of tcp connections, 0 when disabled
+func (proxy *Proxy) timeouts() (time.Duration, time.Duration) {
+	idle, lifetime := time.Duration(0), time.Duration(0)
+	if proxy.IdleTimeout != nil && *proxy.IdleTimeout > 0 {
+		idle = *proxy.IdleTimeout
+	}
+	if proxy.MaxLifetime != nil && *proxy.MaxLifetime > 0 {
+		lifetime = *proxy.MaxLifetime
+	}
+	return idle, lifetime
+}
+
+// expire closes the request once it has no traffic in either direction for idle,
+// or once it is open for lifetime, until the request is done
+func (r *proxyRequest) expire(idle time.Duration, lifetime time.Duration) {
+	var idleC, lifetimeC <-chan time.Time
+	var idleTimer *time.Timer
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if lifetime > 0 {
+		lifetimeTimer := time.NewTimer(lifetime - time.Since(r.started))
+		defer lifetimeTimer.Stop()
+		lifetimeC = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-idleC:
+			// Wait again for the rest of the timeout after traffic
+			if left := idle - r.idle(time.Now()); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			r.proxy.log().Printf("Connection #%d from %s idle for %s, closing", r.id, r.client.RemoteAddr(), idle)
+			expiredConnections.Inc("idle")
+		case <-lifetimeC:
+			r.proxy.log().Printf("Connection #%d from %s reached its maximum lifetime of %s, closing", r.id, r.client.RemoteAddr(), lifetime)
+			expiredConnections.Inc("lifetime")
+		}
+		r.cancel()
+		return
+	}
+}
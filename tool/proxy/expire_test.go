@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// expireProxy starts a proxy to an echo server, returning the proxy and a stop function
+func expireProxy(t *testing.T, idle time.Duration, lifetime time.Duration) (*Proxy, func()) {
+	echo := tcpEcho(t)
+	proxy := testProxy(echo.Addr().String())
+	proxy.IdleTimeout = &idle
+	proxy.MaxLifetime = &lifetime
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- proxy.Serve(ctx)
+	}()
+	return proxy, func() {
+		cancel()
+		<-done
+		echo.Close()
+	}
+}
+
+// closedWithin returns the time it took the proxy to close conn, pinging it every tick if tick is set
+func closedWithin(t *testing.T, conn net.Conn, tick time.Duration) time.Duration {
+	start := time.Now()
+	conn.SetDeadline(start.Add(5 * time.Second))
+	buf := make([]byte, 4)
+	for {
+		if tick > 0 {
+			time.Sleep(tick)
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return time.Since(start)
+			}
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				t.Fatal("connection was not closed")
+			}
+			return time.Since(start)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	proxy, stop := expireProxy(t, 200*time.Millisecond, 0)
+	defer stop()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Traffic keeps the connection open past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		echoConn(t, conn)
+	}
+	if elapsed := closedWithin(t, conn, 0); elapsed > time.Second {
+		t.Fatalf("Expected idle connection to be closed after 200ms, took %s", elapsed)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	proxy, stop := expireProxy(t, 0, 300*time.Millisecond)
+	defer stop()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if elapsed := closedWithin(t, conn, 50*time.Millisecond); elapsed > time.Second {
+		t.Fatalf("Expected active connection to be closed after 300ms, took %s", elapsed)
+	}
+}
+
+// echoConn checks a ping comes back on conn
+func echoConn(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("connection closed while active: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward is an extra listen address and the targets its connections are balanced on
+type Forward struct {
+	Source  string
+	Targets []string
+}
+
+// forwarder is a bound listen address and the pool of its targets
+type forwarder struct {
+	listener   net.Listener
+	packetConn net.PacketConn
+	upstreams  *pool
+}
+
+// addr returns the bound address of the forwarder
+func (f *forwarder) addr() net.Addr {
+	if f.listener != nil {
+		return f.listener.Addr()
+	}
+	return f.packetConn.LocalAddr()
+}
+
+// close stops listening
+func (f *forwarder) close() {
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.packetConn != nil {
+		f.packetConn.Close()
+	}
+}
+
+// rangeAddrs expands an address ending with a port range like 8000-8010 into one address per port.
+// Addresses without port range, like unix sockets, are returned as is.
+func rangeAddrs(addr string) ([]string, error) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return []string{addr}, nil
+	}
+	ports := strings.SplitN(addr[i+1:], "-", 2)
+	if len(ports) != 2 {
+		return []string{addr}, nil
+	}
+	first, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return []string{addr}, nil
+	}
+	last, err := strconv.Atoi(ports[1])
+	if err != nil || first < 1 || last > 65535 || last < first {
+		return nil, fmt.Errorf("invalid port range in %s", addr)
+	}
+
+	var addrs []string
+	for port := first; port <= last; port++ {
+		addrs = append(addrs, addr[:i+1]+strconv.Itoa(port))
+	}
+	return addrs, nil
+}
+
+// ParseForward parses a "listen=target[,target...]" forward.
+// Ports can be ranges like ":8000-8010=db:5000-5010", which gives a forward per port.
+// A target with a single port receives the connections of the whole listen range.
+func ParseForward(spec string) ([]Forward, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid forward %q, expected listen=target", spec)
+	}
+
+	sources, err := rangeAddrs(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	forwards := make([]Forward, len(sources))
+	for i, source := range sources {
+		forwards[i].Source = source
+	}
+
+	for _, target := range strings.Split(parts[1], ",") {
+		if target == "" {
+			return nil, fmt.Errorf("empty target in forward %q", spec)
+		}
+		targets, err := rangeAddrs(target)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) != 1 && len(targets) != len(sources) {
+			return nil, fmt.Errorf("forward %q maps %d listen ports onto %d target ports", spec, len(sources), len(targets))
+		}
+		for i := range forwards {
+			forwards[i].Targets = append(forwards[i].Targets, targets[i%len(targets)])
+		}
+	}
+	return forwards, nil
+}
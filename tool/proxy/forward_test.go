@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	for spec, expected := range map[string][]Forward{
+		":8080=backend:80": {
+			{Source: ":8080", Targets: []string{"backend:80"}},
+		},
+		"127.0.0.1:8000-8002=db:5000-5002": {
+			{Source: "127.0.0.1:8000", Targets: []string{"db:5000"}},
+			{Source: "127.0.0.1:8001", Targets: []string{"db:5001"}},
+			{Source: "127.0.0.1:8002", Targets: []string{"db:5002"}},
+		},
+		":8000-8001=a:80,b:90-91": {
+			{Source: ":8000", Targets: []string{"a:80", "b:90"}},
+			{Source: ":8001", Targets: []string{"a:80", "b:91"}},
+		},
+		"unix:///tmp/docker.sock=tcp://127.0.0.1:2375": {
+			{Source: "unix:///tmp/docker.sock", Targets: []string{"tcp://127.0.0.1:2375"}},
+		},
+	} {
+		forwards, err := ParseForward(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(forwards, expected) {
+			t.Errorf("%s: expected %v, got %v", spec, expected, forwards)
+		}
+	}
+
+	for _, spec := range []string{
+		":8080",
+		"=backend:80",
+		":8080=",
+		":8080=a:80,",
+		":8000-8002=db:5000-5001",
+		":8002-8000=db:5000",
+		":8000=db:5000-5001",
+		":0-70000=db:5000",
+	} {
+		if _, err := ParseForward(spec); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+// greeter answers each connection with its name
+func greeter(t *testing.T, name string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, name)
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestForwards(t *testing.T) {
+	one := greeter(t, "one")
+	defer one.Close()
+	two := greeter(t, "two")
+	defer two.Close()
+
+	proxy := testProxy(one.Addr().String())
+	proxy.Forwards = []Forward{{Source: "127.0.0.1:0", Targets: []string{two.Addr().String()}}}
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := proxy.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 listen addresses but got %v", addrs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- proxy.Serve(ctx)
+	}()
+
+	for i, expected := range []string{"one", "two"} {
+		conn, err := net.Dial("tcp", addrs[i].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		got, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(got) != expected {
+			t.Errorf("%s: expected %q, got %q", addrs[i], expected, got)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected clean stop but got %v", err)
+	}
+}
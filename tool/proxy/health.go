@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// report records a health check result and returns true if the upstream changed state.
+// An upstream is taken out after fall failures in a row and put back after rise successes in a row.
+func (u *upstream) report(ok bool, rise int, fall int) bool {
+	u.hm.Lock()
+	defer u.hm.Unlock()
+
+	if ok {
+		u.fails = 0
+		u.rises++
+		if u.down && u.rises >= rise {
+			u.down = false
+			return true
+		}
+		return false
+	}
+
+	u.rises = 0
+	u.fails++
+	if !u.down && u.fails >= fall {
+		u.down = true
+		return true
+	}
+	return false
+}
+
+// healthy returns false if the upstream was taken out of rotation
+func (u *upstream) healthy() bool {
+	u.hm.Lock()
+	defer u.hm.Unlock()
+
+	return !u.down
+}
+
+func (proxy *Proxy) healthCheckEnabled() bool {
+	return proxy.HealthInterval != nil && *proxy.HealthInterval > 0 &&
+		!strings.HasPrefix(*proxy.Protocol, "udp")
+}
+
+func (proxy *Proxy) healthThresholds() (int, int) {
+	rise, fall := 1, 1
+	if proxy.HealthRise != nil && *proxy.HealthRise > 0 {
+		rise = *proxy.HealthRise
+	}
+	if proxy.HealthFall != nil && *proxy.HealthFall > 0 {
+		fall = *proxy.HealthFall
+	}
+	return rise, fall
+}
+
+// probe runs one health check against an upstream.
+// Http checks reach the target like proxied connections, with the PROXY header and tls as configured.
+func (proxy *Proxy) probe(u *upstream, timeout time.Duration) error {
+	if proxy.HealthHTTPPath != nil && *proxy.HealthHTTPPath != "" {
+		path := *proxy.HealthHTTPPath
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+
+		network, address, err := proxy.splitAddr(u.addr)
+		if err != nil {
+			return err
+		}
+		host := address
+		if network == "unix" {
+			host = "localhost"
+		}
+		client := http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					dialer := net.Dialer{Timeout: timeout}
+					conn, err := dialer.DialContext(ctx, network, address)
+					if err != nil {
+						return nil, err
+					}
+					return proxy.prepare(conn, network, address, nil, nil)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", host, path))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+
+	network, address, err := proxy.splitAddr(u.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkHealth probes all upstreams of the pool every health interval until done is closed
+func (proxy *Proxy) checkHealth(p *pool, done <-chan struct{}) {
+	interval := *proxy.HealthInterval
+	rise, fall := proxy.healthThresholds()
+	// Probes use the dial timeout, but must be done before the next one
+	timeout := *proxy.DialTimeOut
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.list() {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+
+				err := proxy.probe(u, timeout)
+				if !u.report(err == nil, rise, fall) {
+					return
+				}
+				if err != nil {
+					proxy.log().Printf("Target %s is down: %v", u.addr, err)
+				} else {
+					proxy.log().Printf("Target %s is up", u.addr)
+				}
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamReport(t *testing.T) {
+	u := &upstream{addr: "a:1"}
+
+	for i, step := range []struct {
+		ok      bool
+		healthy bool
+	}{
+		{false, true},
+		{false, false},
+		{true, false},
+		{false, false},
+		{true, false},
+		{true, true},
+	} {
+		u.report(step.ok, 2, 2)
+		if u.healthy() != step.healthy {
+			t.Fatalf("Step %d: expected healthy to be %v", i, step.healthy)
+		}
+	}
+}
+
+func TestPoolSkipsUnhealthy(t *testing.T) {
+	p, err := newPool(RoundRobin, []string{"a:1", "b:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.list()[0].report(false, 1, 1)
+
+	for i := 0; i < 2; i++ {
+		candidates := p.candidates(nil)
+		if len(candidates) != 1 || candidates[0].addr != "b:1" {
+			t.Fatalf("Expected only b:1 as candidate")
+		}
+	}
+
+	p.list()[1].report(false, 1, 1)
+	if candidates := p.candidates(nil); len(candidates) != 2 {
+		t.Fatalf("Expected all targets when none is healthy but got %d", len(candidates))
+	}
+}
+
+func TestProbe(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	protocol := "tcp"
+	path := "health"
+	proxy := &Proxy{Protocol: &protocol}
+	u := &upstream{addr: strings.TrimPrefix(server.URL, "http://")}
+
+	if err := proxy.probe(u, time.Second); err != nil {
+		t.Fatalf("Expected tcp probe to succeed: %v", err)
+	}
+
+	proxy.HealthHTTPPath = &path
+	if err := proxy.probe(u, time.Second); err != nil {
+		t.Fatalf("Expected http probe to succeed: %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := proxy.probe(u, time.Second); err == nil {
+		t.Fatal("Expected http probe to fail")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy.HealthHTTPPath = nil
+	if err := proxy.probe(&upstream{addr: addr}, time.Second); err == nil {
+		t.Fatal("Expected tcp probe on closed port to fail")
+	}
+}
+
+func TestProbeTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	protocol := "tcp"
+	path := "/health"
+	timeout := time.Second
+	proxy := &Proxy{
+		Protocol:       &protocol,
+		HealthHTTPPath: &path,
+		DialTimeOut:    &timeout,
+		targetTLS:      &tls.Config{InsecureSkipVerify: true},
+	}
+	u := &upstream{addr: strings.TrimPrefix(server.URL, "https://")}
+	if err := proxy.probe(u, time.Second); err != nil {
+		t.Fatalf("Expected http probe over tls to succeed: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// errImpairReset is returned by pipe when an impairment resets the connection
+var errImpairReset = errors.New("connection reset by impairment")
+
+// Impairment describes network impairments applied to proxied chunks
+type Impairment struct {
+	// Latency is added before forwarding each chunk
+	Latency time.Duration
+	// Jitter is a random delay, up to this duration, added to or removed from the latency
+	Jitter time.Duration
+	// RateUp caps the client to target bandwidth in bytes per second, 0 for no limit
+	RateUp int64
+	// RateDown caps the target to client bandwidth in bytes per second, 0 for no limit
+	RateDown int64
+	// ResetProbability is the probability to reset the connection on each chunk
+	ResetProbability float64
+	// StallProbability is the probability to stall the connection on each chunk
+	StallProbability float64
+	// StallDuration is the duration of a stall
+	StallDuration time.Duration
+}
+
+// Validate checks the impairment settings
+func (i Impairment) Validate() error {
+	if i.Latency < 0 || i.Jitter < 0 || i.StallDuration < 0 {
+		return errors.New("impairment durations must be positive")
+	}
+	if i.RateUp < 0 || i.RateDown < 0 {
+		return errors.New("impairment rates must be positive")
+	}
+	if i.ResetProbability < 0 || i.ResetProbability > 1 || i.StallProbability < 0 || i.StallProbability > 1 {
+		return errors.New("impairment probabilities must be between 0 and 1")
+	}
+	return nil
+}
+
+// enabled returns true if any impairment is set
+func (i Impairment) enabled() bool {
+	return i.Latency > 0 || i.Jitter > 0 ||
+		i.RateUp > 0 || i.RateDown > 0 ||
+		i.ResetProbability > 0 || i.StallProbability > 0
+}
+
+// latency returns the time a chunk spends in flight, with jitter
+func (i Impairment) latency() time.Duration {
+	d := i.Latency
+	if i.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*i.Jitter))) - i.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// transmission returns the time a chunk of size bytes takes at the bandwidth limit of a direction
+func (i Impairment) transmission(dir direction, size int) time.Duration {
+	rate := i.RateUp
+	if dir == toClient {
+		rate = i.RateDown
+	}
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(int64(size) * int64(time.Second) / rate)
+}
+
+// CurrentImpairment returns the impairment applied to new chunks
+func (proxy *Proxy) CurrentImpairment() Impairment {
+	proxy.im.RLock()
+	defer proxy.im.RUnlock()
+
+	if proxy.impairment != nil {
+		return *proxy.impairment
+	}
+	if proxy.Impairment != nil {
+		return *proxy.Impairment
+	}
+	return Impairment{}
+}
+
+// SetImpairment changes the impairment of running connections
+func (proxy *Proxy) SetImpairment(i Impairment) error {
+	if err := i.Validate(); err != nil {
+		return err
+	}
+
+	proxy.im.Lock()
+	defer proxy.im.Unlock()
+	proxy.impairment = &i
+	return nil
+}
+
+// sleep waits for d, returning false if the request is done before
+func (r *proxyRequest) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-r.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// tcpConn returns the tcp connection under the PROXY header, peeking, buffering and tls wrappers of conn,
+// or nil if there is none
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *proxyProtoConn:
+			conn = c.Conn
+		case *peekedConn:
+			conn = c.Conn
+		case *bufferedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			// tls connections, since go 1.18
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// impair applies the resets and stalls of the current impairment to a chunk,
+// returning the latency to deliver it with
+func (r *proxyRequest) impair() (time.Duration, error) {
+	if r.proxy == nil {
+		return 0, nil
+	}
+	i := r.proxy.CurrentImpairment()
+	if !i.enabled() {
+		return 0, nil
+	}
+
+	if i.ResetProbability > 0 && rand.Float64() < i.ResetProbability {
+		// Drop pending data so closing sends a reset
+		for _, conn := range []net.Conn{r.client, r.server} {
+			if tcpConn := tcpConn(conn); tcpConn != nil {
+				tcpConn.SetLinger(0)
+			}
+		}
+		return 0, errImpairReset
+	}
+
+	if i.StallProbability > 0 && rand.Float64() < i.StallProbability {
+		r.proxy.log().Printf("Stalling connection #%d for %s", r.id, i.StallDuration)
+		if !r.sleep(i.StallDuration) {
+			return 0, nil
+		}
+	}
+	return i.latency(), nil
+}
+
+// throttle waits for the time a chunk of size bytes takes at the current bandwidth limit of a direction
+func (r *proxyRequest) throttle(dir direction, size int) {
+	if r.proxy != nil {
+		r.sleep(r.proxy.CurrentImpairment().transmission(dir, size))
+	}
+}
+
+// delayedChunk is a chunk waiting for its delivery time
+type delayedChunk struct {
+	data []byte
+	due  time.Time
+}
+
+// delayQueueSize is the number of chunks in flight before the pipe stops reading
+const delayQueueSize = 64
+
+// delayQueue delivers chunks to an output once their latency is over, so the pipe keeps reading meanwhile
+type delayQueue struct {
+	chunks chan delayedChunk
+	// done receives the first write error, or nil once all chunks are delivered
+	done   chan error
+	closed bool
+}
+
+// delayQueue starts delivering the chunks of a direction to output
+func (r *proxyRequest) delayQueue(dir direction, output io.Writer) *delayQueue {
+	q := &delayQueue{
+		chunks: make(chan delayedChunk, delayQueueSize),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		for chunk := range q.chunks {
+			if !r.sleep(time.Until(chunk.due)) {
+				return
+			}
+			r.throttle(dir, len(chunk.data))
+			if _, err := output.Write(chunk.data); err != nil {
+				q.done <- err
+				return
+			}
+		}
+		q.done <- nil
+	}()
+	return q
+}
+
+// push queues a copy of data for delivery after latency
+func (q *delayQueue) push(ctx context.Context, data []byte, latency time.Duration) error {
+	chunk := delayedChunk{
+		data: append([]byte(nil), data...),
+		due:  time.Now().Add(latency),
+	}
+	select {
+	case q.chunks <- chunk:
+		return nil
+	case err := <-q.done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// close stops queuing chunks
+func (q *delayQueue) close() {
+	if !q.closed {
+		q.closed = true
+		close(q.chunks)
+	}
+}
+
+// flush waits for the queued chunks to be delivered
+func (q *delayQueue) flush(ctx context.Context) error {
+	q.close()
+	select {
+	case err := <-q.done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestImpairmentDelay(t *testing.T) {
+	i := Impairment{
+		Latency:  100 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+		RateUp:   1000,
+		RateDown: 0,
+	}
+
+	for n := 0; n < 100; n++ {
+		if d := i.latency() + i.transmission(toTarget, 500); d < 590*time.Millisecond || d > 610*time.Millisecond {
+			t.Fatalf("Expected up delay around 600ms but got %s", d)
+		}
+		if d := i.latency() + i.transmission(toClient, 500); d < 90*time.Millisecond || d > 110*time.Millisecond {
+			t.Fatalf("Expected down delay around 100ms but got %s", d)
+		}
+	}
+}
+
+func TestImpairmentValidate(t *testing.T) {
+	for _, i := range []Impairment{
+		{Latency: -time.Second},
+		{RateUp: -1},
+		{ResetProbability: 1.5},
+		{StallProbability: -0.1},
+	} {
+		if err := i.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be invalid", i)
+		}
+	}
+
+	proxy := &Proxy{}
+	if err := proxy.SetImpairment(Impairment{ResetProbability: 2}); err == nil {
+		t.Fatal("Expected invalid impairment to be rejected")
+	}
+	if err := proxy.SetImpairment(Impairment{Latency: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.CurrentImpairment().Latency != time.Second {
+		t.Fatal("Expected impairment to be changed")
+	}
+}
+
+func TestImpairedPipe(t *testing.T) {
+	quiet := true
+	proxy := &Proxy{QuietFlag: &quiet}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := proxyRequest{
+		proxy:  proxy,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	proxy.SetImpairment(Impairment{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	output := strings.Builder{}
+	if err := r.pipe(toTarget, strings.NewReader("Hello"), &output); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected latency to be applied but took %s", elapsed)
+	}
+	if output.String() != "Hello" {
+		t.Fatalf("Expected Hello but got %q", output.String())
+	}
+
+	// Latency delays each chunk but doesn't stop reading the next ones
+	ctx, cancel = context.WithCancel(context.Background())
+	r.ctx, r.cancel = ctx, cancel
+	proxy.SetImpairment(Impairment{Latency: 100 * time.Millisecond})
+	start = time.Now()
+	output = strings.Builder{}
+	if err := r.pipe(toTarget, iotest.OneByteReader(strings.NewReader("Hello")), &output); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Fatalf("Expected chunks to be delayed together but took %s", elapsed)
+	}
+	if output.String() != "Hello" {
+		t.Fatalf("Expected Hello but got %q", output.String())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	r.ctx, r.cancel = ctx, cancel
+	proxy.SetImpairment(Impairment{ResetProbability: 1})
+	if err := r.pipe(toTarget, strings.NewReader("Hello"), &strings.Builder{}); err != errImpairReset {
+		t.Fatalf("Expected reset but got %v", err)
+	}
+}
+
+func TestTCPConnUnwrap(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw := conn.(*net.TCPConn)
+	for _, wrapped := range []net.Conn{
+		conn,
+		&proxyProtoConn{Conn: conn},
+		&peekedConn{Conn: &proxyProtoConn{Conn: conn}},
+		&bufferedConn{Conn: conn},
+	} {
+		if tcpConn(wrapped) != raw {
+			t.Fatalf("Expected %T to unwrap to the tcp connection", wrapped)
+		}
+	}
+	if tcpConn(&sniffConn{}) != nil {
+		t.Fatal("Expected no tcp connection")
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errLimited = errors.New("connection limit reached")
+
+// limiter caps concurrent connections, globally and per source ip, and rate limits accepts with a token bucket.
+// Global slots are taken when accepting, source slots once the client address is known.
+type limiter struct {
+	m sync.Mutex
+
+	max   int
+	perIP int
+	// rate is the number of accepts per second, 0 for no limit
+	rate  float64
+	burst float64
+
+	total   int
+	sources map[string]int
+	tokens  float64
+	last    time.Time
+	// changed is closed and replaced each time a connection is released
+	changed chan struct{}
+}
+
+func newLimiter(max int, perIP int, rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		max:     max,
+		perIP:   perIP,
+		rate:    rate,
+		burst:   float64(burst),
+		sources: make(map[string]int),
+		tokens:  float64(burst),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// refill adds the tokens earned since the last refill, must be called with the lock held
+func (l *limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// notify wakes up the connections waiting for room, must be called with the lock held
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// trySlot takes a global slot and a token, or returns how long to wait for the next token
+// (0 when waiting on a release) and the channel closed on the next release
+func (l *limiter) trySlot() (bool, time.Duration, chan struct{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false, 0, l.changed
+	}
+	if l.rate > 0 {
+		l.refill(time.Now())
+		if l.tokens < 1 {
+			return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), l.changed
+		}
+		l.tokens--
+	}
+
+	l.total++
+	return true, 0, nil
+}
+
+// trySource takes a slot of source, or returns the channel closed on the next release
+func (l *limiter) trySource(source string) (bool, time.Duration, chan struct{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.perIP > 0 && l.sources[source] >= l.perIP {
+		return false, 0, l.changed
+	}
+	l.sources[source]++
+	return true, 0, nil
+}
+
+// acquireSlot admits a connection under the global and rate limits, waiting up to wait for room.
+// A wait of 0 rejects the connection right away when over a limit.
+func (l *limiter) acquireSlot(ctx context.Context, wait time.Duration) error {
+	return l.wait(ctx, wait, l.trySlot)
+}
+
+// acquireSource admits a connection from source under the per ip limit, waiting up to wait for room
+func (l *limiter) acquireSource(ctx context.Context, source string, wait time.Duration) error {
+	return l.wait(ctx, wait, func() (bool, time.Duration, chan struct{}) {
+		return l.trySource(source)
+	})
+}
+
+// wait calls try until it admits the connection, up to wait
+func (l *limiter) wait(ctx context.Context, wait time.Duration, try func() (bool, time.Duration, chan struct{})) error {
+	deadline := time.Now().Add(wait)
+	for {
+		ok, next, changed := try()
+		if ok {
+			return nil
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return errLimited
+		}
+		if next > 0 && next < left {
+			left = next
+		}
+
+		timer := time.NewTimer(left)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// releaseSlot frees a global slot
+func (l *limiter) releaseSlot() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.total--
+	l.notify()
+}
+
+// releaseSource frees a slot of source
+func (l *limiter) releaseSource(source string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.sources[source]--
+	if l.sources[source] <= 0 {
+		delete(l.sources, source)
+	}
+	l.notify()
+}
+
+// sourceIP returns the ip of addr, or addr itself if it has no port
+func sourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limits returns the connection limiter of the proxy, or nil if no limit is configured
+func (proxy *Proxy) limits() *limiter {
+	max, perIP, rate, burst := 0, 0, 0.0, 0
+	if proxy.MaxConns != nil {
+		max = *proxy.MaxConns
+	}
+	if proxy.MaxConnsPerIP != nil {
+		perIP = *proxy.MaxConnsPerIP
+	}
+	if proxy.AcceptRate != nil {
+		rate = *proxy.AcceptRate
+	}
+	if proxy.AcceptBurst != nil {
+		burst = *proxy.AcceptBurst
+	}
+	if max <= 0 && perIP <= 0 && rate <= 0 {
+		return nil
+	}
+	return newLimiter(max, perIP, rate, burst)
+}
+
+func (proxy *Proxy) limitWait() time.Duration {
+	if proxy.LimitWait == nil {
+		return 0
+	}
+	return *proxy.LimitWait
+}
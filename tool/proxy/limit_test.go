@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterCaps(t *testing.T) {
+	l := newLimiter(2, 1, 0, 0)
+	ctx := context.Background()
+
+	if err := l.acquireSlot(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquireSource(ctx, "10.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquireSource(ctx, "10.0.0.1", 0); err != errLimited {
+		t.Fatalf("expected per ip limit, got %v", err)
+	}
+	if err := l.acquireSlot(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquireSource(ctx, "10.0.0.2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquireSlot(ctx, 0); err != errLimited {
+		t.Fatalf("expected global limit, got %v", err)
+	}
+
+	l.releaseSource("10.0.0.1")
+	l.releaseSlot()
+	if err := l.acquireSlot(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.sources["10.0.0.1"]; ok {
+		t.Fatal("released source should be forgotten")
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	l := newLimiter(1, 0, 0, 0)
+	ctx := context.Background()
+
+	if err := l.acquireSlot(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.releaseSlot()
+	}()
+	if err := l.acquireSlot(ctx, time.Second); err != nil {
+		t.Fatalf("queued connection should get the released slot, got %v", err)
+	}
+
+	start := time.Now()
+	if err := l.acquireSlot(ctx, 50*time.Millisecond); err != errLimited {
+		t.Fatalf("expected limit after wait, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("connection should have been queued")
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(0, 0, 20, 2)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquireSlot(ctx, 0); err != nil {
+			t.Fatalf("burst %d: %v", i, err)
+		}
+	}
+	if err := l.acquireSlot(ctx, 0); err != errLimited {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+	if err := l.acquireSlot(ctx, time.Second); err != nil {
+		t.Fatalf("expected a token after waiting, got %v", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	max := 1
+	proxy.MaxConns = &max
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	first, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// Make sure the first connection holds the slot
+	if _, err := first.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := first.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(buf); err == nil {
+		t.Fatal("second connection should be rejected")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("second connection should be closed, not left open")
+	}
+}
+
+func TestMaxConnsPerIPAcceptProxy(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	perIP := 1
+	accept := true
+	proxy.MaxConnsPerIP = &perIP
+	proxy.AcceptProxy = &accept
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	// Clients behind the same load balancer have their own slot
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		src := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		if err := writeProxyHeader(conn, ProxyProtoV1, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("connection from %s should be accepted: %v", ip, err)
+		}
+	}
+}
+
+func TestMaxConnsBeforeProxyHeader(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	max := 1
+	accept := true
+	proxy.MaxConns = &max
+	proxy.AcceptProxy = &accept
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	// A client sending nothing holds the only slot while the proxy waits for its header
+	idle, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	second, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("second connection should be rejected")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("second connection should be rejected before the header timeout")
+	}
+	if active := atomic.LoadInt64(&proxy.active); active != 0 {
+		t.Fatalf("Expected rejected and pending connections not to be active, got %d", active)
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"github.com/pijalu/kitchensink/metrics"
+)
+
+var (
+	acceptedConnections = metrics.NewCounter("kitchensink_proxy_connections_accepted_total",
+		"Number of accepted proxy connections.")
+	activeConnections = metrics.NewGauge("kitchensink_proxy_connections_active",
+		"Number of open proxy connections.")
+	failedConnections = metrics.NewCounter("kitchensink_proxy_connections_failed_total",
+		"Number of proxy connections closed before reaching a target.")
+	proxiedBytes = metrics.NewCounter("kitchensink_proxy_bytes_total",
+		"Number of proxied bytes.", "direction")
+	rejectedConnections = metrics.NewCounter("kitchensink_proxy_connections_rejected_total",
+		"Number of proxy connections rejected by connection limits.")
+	expiredConnections = metrics.NewCounter("kitchensink_proxy_connections_expired_total",
+		"Number of proxy connections closed by the idle timeout or the maximum lifetime.", "reason")
+	mirrorDroppedBytes = metrics.NewCounter("kitchensink_proxy_mirror_dropped_bytes_total",
+		"Number of bytes not sent to the mirror because it could not keep up.")
+	dialDuration = metrics.NewHistogram("kitchensink_proxy_dial_duration_seconds",
+		"Duration of target dials.", nil, "target")
+)
+
+// label returns the metrics label of a direction
+func (d direction) label() string {
+	if d == toTarget {
+		return "to_target"
+	}
+	return "to_client"
+}
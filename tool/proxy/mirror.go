@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// mirrorQueueSize is the number of chunks waiting for a slow mirror before chunks get dropped
+const mirrorQueueSize = 256
+
+// mirrorFlushTimeout is the time given to send queued chunks once the proxied connection closed
+const mirrorFlushTimeout = time.Second
+
+// mirror copies client data to a shadow upstream, throwing its responses away.
+// It never blocks the proxied connection: chunks are dropped when the mirror can't keep up.
+type mirror struct {
+	// dropped is the number of bytes not sent to the mirror (atomic)
+	dropped int64
+
+	chunks chan []byte
+	done   chan struct{}
+}
+
+// openMirror starts mirroring to addr, dialing it in the background
+func (proxy *Proxy) openMirror(ctx context.Context, addr string) *mirror {
+	m := &mirror{
+		chunks: make(chan []byte, mirrorQueueSize),
+		done:   make(chan struct{}),
+	}
+	go m.run(ctx, proxy, addr)
+	return m
+}
+
+func (m *mirror) run(ctx context.Context, proxy *Proxy, addr string) {
+	defer func() {
+		if dropped := atomic.LoadInt64(&m.dropped); dropped > 0 {
+			proxy.log().Printf("Dropped %d bytes mirrored to %s", dropped, addr)
+			mirrorDroppedBytes.Add(float64(dropped))
+		}
+	}()
+
+	network, address, err := proxy.splitAddr(addr)
+	var conn net.Conn
+	if err == nil {
+		dialer := net.Dialer{Timeout: *proxy.DialTimeOut}
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		proxy.log().Printf("Failed to dial mirror %s: %v", addr, err)
+		m.discard()
+		return
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	// Give up on pending writes shortly after done
+	go func() {
+		<-m.done
+		conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	}()
+
+	for {
+		select {
+		case chunk := <-m.chunks:
+			if !m.write(proxy, conn, chunk) {
+				return
+			}
+		case <-m.done:
+			// Flush queued chunks
+			for {
+				select {
+				case chunk := <-m.chunks:
+					if !m.write(proxy, conn, chunk) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write sends a chunk to the mirror. On failure, all following chunks are dropped.
+func (m *mirror) write(proxy *Proxy, conn net.Conn, chunk []byte) bool {
+	if _, err := conn.Write(chunk); err != nil {
+		select {
+		case <-m.done:
+		default:
+			proxy.log().Printf("Error writing to mirror %s: %v", conn.RemoteAddr(), err)
+		}
+		atomic.AddInt64(&m.dropped, int64(len(chunk)))
+		m.discard()
+		return false
+	}
+	return true
+}
+
+// discard drops chunks until the mirror is closed
+func (m *mirror) discard() {
+	for {
+		select {
+		case chunk := <-m.chunks:
+			atomic.AddInt64(&m.dropped, int64(len(chunk)))
+		case <-m.done:
+			for {
+				select {
+				case chunk := <-m.chunks:
+					atomic.AddInt64(&m.dropped, int64(len(chunk)))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send queues a copy of chunk, dropping it if the queue is full
+func (m *mirror) send(chunk []byte) {
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+
+	select {
+	case m.chunks <- append([]byte(nil), chunk...):
+	default:
+		atomic.AddInt64(&m.dropped, int64(len(chunk)))
+	}
+}
+
+// close stops mirroring once queued chunks are sent
+func (m *mirror) close() {
+	close(m.done)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// runMirrorProxy serves a mirroring proxy until the returned function is called
+func runMirrorProxy(t *testing.T, target string, mirror string) (*Proxy, func()) {
+	proxy := testProxy(target)
+	proxy.Mirror = &mirror
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Serve(ctx)
+		close(done)
+	}()
+	return proxy, func() {
+		cancel()
+		<-done
+	}
+}
+
+// echoThrough sends data through the proxy and checks it comes back
+func echoThrough(t *testing.T, proxy *Proxy, data []byte) {
+	conn, err := net.Dial(proxy.Addr().Network(), proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("unexpected echo")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	shadow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	mirrored := make(chan []byte, 1)
+	go func() {
+		conn, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		// The response must be thrown away
+		io.WriteString(conn, "ignored")
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		mirrored <- data
+	}()
+
+	proxy, stop := runMirrorProxy(t, echo.Addr().String(), shadow.Addr().String())
+	defer stop()
+	echoThrough(t, proxy, []byte("hello mirror"))
+
+	select {
+	case data := <-mirrored:
+		if string(data) != "hello mirror" {
+			t.Fatalf("expected mirrored data, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror got nothing")
+	}
+}
+
+func TestMirrorSlowOrDead(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	// A mirror that never reads
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// A mirror refusing connections
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	for _, addr := range []string{stalled.Addr().String(), dead.Addr().String()} {
+		proxy, stop := runMirrorProxy(t, echo.Addr().String(), addr)
+		echoThrough(t, proxy, data)
+		stop()
+	}
+}
+
+func TestMirrorDrops(t *testing.T) {
+	m := &mirror{
+		chunks: make(chan []byte, 1),
+		done:   make(chan struct{}),
+	}
+	m.send([]byte("kept"))
+	m.send([]byte("dropped"))
+	if m.dropped != int64(len("dropped")) {
+		t.Fatalf("expected %d dropped bytes, got %d", len("dropped"), m.dropped)
+	}
+
+	m.close()
+	m.send([]byte("closed"))
+	if len(m.chunks) != 1 {
+		t.Fatal("closed mirror should not queue chunks")
+	}
+}
@@ -1,26 +1,147 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pijalu/kitchensink/acl"
 	"github.com/pijalu/kitchensink/quietlog"
+	"github.com/pijalu/kitchensink/tool/replay"
 )
 
 // Proxy represent a proxy
 type Proxy struct {
-	QuietFlag   *bool
-	SourceAddr  *string
-	TargetAddr  *string
+	// connection counters (atomic), kept first for alignment
+	active int64
+	closed int64
+	nextID uint64
+
+	QuietFlag *bool
+	// SourceAddr and TargetAddrs use Protocol, unless prefixed by a tcp://, tcp4://, tcp6:// or unix:// scheme
+	SourceAddr *string
+	// TargetAddrs are the upstreams connections are balanced on
+	TargetAddrs []string
+	// SocketMode sets the octal permissions of a unix socket source, like 0660
+	SocketMode *string
+	// Balance is the balancing strategy: roundrobin, leastconn, random or sourcehash
+	Balance     *string
 	Protocol    *string
 	DialTimeOut *time.Duration
-	Log         *quietlog.QuietLogger
+	// UDPIdleTimeout closes udp sessions without traffic for this duration
+	UDPIdleTimeout *time.Duration
+	// HealthInterval is the delay between upstream health checks, 0 to disable them
+	HealthInterval *time.Duration
+	// HealthRise is the number of successful checks to put a target back in rotation
+	HealthRise *int
+	// HealthFall is the number of failed checks to take a target out of rotation
+	HealthFall *int
+	// HealthHTTPPath makes health checks use a http GET on this path instead of a tcp connect
+	HealthHTTPPath *string
+	// DialRetries is the number of extra attempts over all targets when none could be dialed
+	DialRetries *int
+	// RetryBackoff is the delay before the first retry, doubled on each retry
+	RetryBackoff *time.Duration
+	// BreakerThreshold is the number of failed dials in a row opening a target circuit breaker, 0 to disable it
+	BreakerThreshold *int
+	// BreakerCooldown is the time a target is skipped once its circuit breaker opened
+	BreakerCooldown *time.Duration
+	// TLSCertFile and TLSKeyFile make the listener accept tls connections
+	TLSCertFile *string
+	TLSKeyFile  *string
+	// TLSClientCAFile requires clients to present a certificate signed by this CA bundle
+	TLSClientCAFile *string
+	// TargetTLS makes the proxy dial targets over tls
+	TargetTLS *bool
+	// TargetSNI overrides the server name sent to and verified against targets
+	TargetSNI *string
+	// TargetCAFile is the CA bundle used to verify targets instead of the system roots
+	TargetCAFile *string
+	// TargetCertFile and TargetKeyFile are the client certificate presented to targets
+	TargetCertFile *string
+	TargetKeyFile  *string
+	// TargetInsecure skips target certificate verification
+	TargetInsecure *bool
+	// SendProxy sends a PROXY protocol header to targets: v1 or v2, empty to disable
+	SendProxy *string
+	// AcceptProxy requires clients to start with a PROXY protocol header giving the real client address
+	AcceptProxy *bool
+	// CaptureFile records proxied tcp connections as synthesized packets in this pcap file
+	CaptureFile *string
+	// Dump prints proxied chunks: hex, text or both, empty to disable
+	Dump *string
+	// DumpMax is the maximum number of bytes printed per chunk, 0 for no limit
+	DumpMax *int
+	// DumpOutput receives dumped chunks, stdout if nil
+	DumpOutput io.Writer
+	// Impairment is the initial network impairment applied to proxied chunks, see SetImpairment
+	Impairment *Impairment
+	// AdminAddr is the listen address of the admin http api, empty to disable it
+	AdminAddr *string
+	// RecordFile records the data of proxied tcp connections in this session file, see the replay package
+	RecordFile *string
+	// Mirror receives a copy of the data sent by clients, its responses are thrown away.
+	// A slow mirror never slows down proxied connections, data is dropped instead.
+	Mirror *string
+	// SNIRoutes are "host=target" routes picked from the server name of tls clients, which is not terminated.
+	// A host can start with "*." to match subdomains. Unmatched clients go to the targets of their listener.
+	SNIRoutes []string
+	// Forwards are extra listen addresses, each with its own targets and accept loop.
+	// The admin api manages the targets of SourceAddr only.
+	Forwards []Forward
+	// ACL filters clients by ip, nil to allow everyone
+	ACL *acl.List
+	// MaxConns caps concurrent tcp connections, 0 for no limit
+	MaxConns *int
+	// MaxConnsPerIP caps concurrent tcp connections from a single source ip, 0 for no limit
+	MaxConnsPerIP *int
+	// AcceptRate limits accepted tcp connections per second, 0 for no limit
+	AcceptRate *float64
+	// AcceptBurst is the number of connections accepted at once above the accept rate
+	AcceptBurst *int
+	// LimitWait queues connections over a limit for up to this duration, 0 rejects them right away
+	LimitWait *time.Duration
+	// IdleTimeout closes tcp connections without traffic in either direction for this duration, 0 to disable it
+	IdleTimeout *time.Duration
+	// MaxLifetime closes tcp connections open for this duration, 0 for no limit
+	MaxLifetime *time.Duration
+	// DrainTimeout is the time given to open connections to finish once the proxy stops
+	DrainTimeout *time.Duration
+	Log          *quietlog.QuietLogger
+
+	im         sync.RWMutex
+	impairment *Impairment
+
+	rm       sync.Mutex
+	requests map[uint64]*proxyRequest
+
+	poolOnce sync.Once
+	pool     *pool
+	poolErr  error
+
+	forwarders []*forwarder
+	serverTLS  *tls.Config
+	targetTLS  *tls.Config
+	capture    *pcapWriter
+	dumper     *dumper
+	limiter    *limiter
+	sniPools   map[string]*pool
+	recorder   *replay.Recorder
 }
 
+// defaultUDPIdleTimeout is used when no udp idle timeout is configured
+const defaultUDPIdleTimeout = 60 * time.Second
+
 // Quiet returns true if the tool should keep being quiet
 func (proxy *Proxy) Quiet() bool {
 	return (proxy.QuietFlag != nil) && *proxy.QuietFlag
@@ -33,90 +154,748 @@ func (proxy *Proxy) log() *quietlog.QuietLogger {
 	return proxy.Log
 }
 
-// Run proxy
-func (proxy *Proxy) Run() {
-	listener, err := net.Listen(*proxy.Protocol, *proxy.SourceAddr)
+func (proxy *Proxy) udpIdleTimeout() time.Duration {
+	if proxy.UDPIdleTimeout == nil || *proxy.UDPIdleTimeout <= 0 {
+		return defaultUDPIdleTimeout
+	}
+	return *proxy.UDPIdleTimeout
+}
+
+func (proxy *Proxy) strategy() string {
+	if proxy.Balance == nil {
+		return ""
+	}
+	return *proxy.Balance
+}
+
+// upstreams returns the pool of targets of SourceAddr
+func (proxy *Proxy) upstreams() (*pool, error) {
+	proxy.poolOnce.Do(func() {
+		proxy.pool, proxy.poolErr = newPool(proxy.strategy(), proxy.TargetAddrs)
+	})
+	return proxy.pool, proxy.poolErr
+}
+
+// dial connects to the first reachable target for a client connected to local
+func (proxy *Proxy) dial(ctx context.Context, client net.Addr, local net.Addr) (net.Conn, *upstream, error) {
+	upstreams, err := proxy.upstreams()
+	if err != nil {
+		return nil, nil, err
+	}
+	return proxy.dialPool(ctx, upstreams, client, local)
+}
+
+// prepare sends the PROXY header and starts tls on a new target connection, closing it on failure
+func (proxy *Proxy) prepare(conn net.Conn, network string, address string, client net.Addr, local net.Addr) (net.Conn, error) {
+	if proxy.sendProxy() != "" {
+		if err := writeProxyHeader(conn, proxy.sendProxy(), client, local); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if proxy.targetTLS != nil {
+		return proxy.originate(conn, network, address)
+	}
+	return conn, nil
+}
+
+// dialPool connects to the first reachable upstream of a pool for a client connected to local
+func (proxy *Proxy) dialPool(ctx context.Context, upstreams *pool, client net.Addr, local net.Addr) (net.Conn, *upstream, error) {
+	dialer := net.Dialer{Timeout: *proxy.DialTimeOut}
+	threshold, cooldown := proxy.breakerSettings()
+	lastErr := errNoUpstream
+	candidates := upstreams.candidates(client)
+	if len(candidates) > 0 {
+		lastErr = errCircuitOpen
+	}
+	for _, u := range candidates {
+		if !u.allow(time.Now()) {
+			continue
+		}
+
+		start := time.Now()
+		network, address, err := proxy.splitAddr(u.addr)
+		var conn net.Conn
+		if err == nil {
+			conn, err = dialer.DialContext(ctx, network, address)
+		}
+		dialDuration.Observe(time.Since(start).Seconds(), u.addr)
+		if err == nil {
+			conn, err = proxy.prepare(conn, network, address, client, local)
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if u.dialed(err, threshold, cooldown) {
+			proxy.log().Printf("Circuit breaker open for %s during %s", u.addr, cooldown)
+		}
+		if err == nil {
+			return conn, u, nil
+		}
+		proxy.log().Printf("Failed to dial %s for %s: %v", proxy.label(u.addr), client, err)
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+// dialRetry dials like dialPool, retrying with an exponential backoff
+func (proxy *Proxy) dialRetry(ctx context.Context, upstreams *pool, client net.Addr, local net.Addr) (net.Conn, *upstream, error) {
+	retries, backoff := proxy.retrySettings()
+	for attempt := 0; ; attempt++ {
+		conn, target, err := proxy.dialPool(ctx, upstreams, client, local)
+		if err == nil || attempt >= retries || err == errCircuitOpen || err == ctx.Err() {
+			return conn, target, err
+		}
+
+		proxy.log().Printf("Retrying dial for %s in %s (%d/%d)", client, backoff, attempt+1, retries)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (proxy *Proxy) udp() bool {
+	return strings.HasPrefix(*proxy.Protocol, "udp")
+}
+
+// Listen binds the proxy source address and the forwards. Use Addr and Addrs to get the bound addresses.
+func (proxy *Proxy) Listen() error {
+	if !set(proxy.SourceAddr) && len(proxy.Forwards) == 0 {
+		return errors.New("no listen address")
+	}
+	if _, err := proxy.upstreams(); err != nil {
+		return err
+	}
+	if err := proxy.checkAddrs(); err != nil {
+		return err
+	}
+	targetTLS, err := proxy.clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	proxy.targetTLS = targetTLS
+
+	switch proxy.sendProxy() {
+	case "", ProxyProtoV1, ProxyProtoV2:
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %s", proxy.sendProxy())
+	}
+	if proxy.udp() && (proxy.sendProxy() != "" || proxy.acceptProxy()) {
+		return errors.New("PROXY protocol is not supported over udp")
+	}
+	if proxy.udp() && set(proxy.Mirror) {
+		return errors.New("mirroring is not supported over udp")
+	}
+	if proxy.udp() && set(proxy.RecordFile) {
+		return errors.New("recording is not supported over udp")
+	}
+	if proxy.udp() && set(proxy.CaptureFile) {
+		return errors.New("capture is not supported over udp")
+	}
+	if proxy.udp() && set(proxy.Dump) {
+		return errors.New("dump is not supported over udp")
+	}
+	if len(proxy.SNIRoutes) > 0 {
+		if proxy.udp() {
+			return errors.New("SNI routing is not supported over udp")
+		}
+		if proxy.tlsTermination() || proxy.targetTLS != nil {
+			return errors.New("SNI routing passes tls through and can't be combined with tls termination or origination")
+		}
+		if proxy.sniPools, err = proxy.sniRoutes(); err != nil {
+			return err
+		}
+	}
+
+	if proxy.udp() && proxy.tlsTermination() {
+		return errors.New("tls termination is not supported over udp")
+	}
+	if set(proxy.TLSClientCAFile) && !proxy.tlsTermination() {
+		return errors.New("client certificate verification requires a tls certificate and key")
+	}
+
+	if proxy.Impairment != nil {
+		if err := proxy.Impairment.Validate(); err != nil {
+			return err
+		}
+	}
+	if !proxy.udp() {
+		if proxy.tlsTermination() {
+			if proxy.serverTLS, err = proxy.serverTLSConfig(); err != nil {
+				return err
+			}
+		}
+		proxy.limiter = proxy.limits()
+	}
+
+	if set(proxy.SourceAddr) {
+		upstreams, _ := proxy.upstreams()
+		if err := proxy.listen(*proxy.SourceAddr, upstreams); err != nil {
+			return err
+		}
+	}
+	for _, forward := range proxy.Forwards {
+		upstreams, err := newPool(proxy.strategy(), forward.Targets)
+		if err == nil {
+			err = proxy.listen(forward.Source, upstreams)
+		}
+		if err != nil {
+			proxy.closeListeners()
+			return err
+		}
+		proxy.log().Printf("Forwarding %s to %s", proxy.label(forward.Source), strings.Join(forward.Targets, ", "))
+	}
+	return nil
+}
+
+// listen binds a source address whose connections are balanced on upstreams
+func (proxy *Proxy) listen(source string, upstreams *pool) error {
+	network, address, err := proxy.splitAddr(source)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
+	}
+
+	f := &forwarder{upstreams: upstreams}
+	if proxy.udp() {
+		f.packetConn, err = net.ListenPacket(network, address)
+	} else if network == "unix" {
+		f.listener, err = proxy.listenUnix(address)
+	} else {
+		f.listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return err
+	}
+	proxy.forwarders = append(proxy.forwarders, f)
+	proxy.log().Printf("Listening on %s/%s", f.addr(), network)
+	return nil
+}
+
+// closeListeners stops listening on all addresses
+func (proxy *Proxy) closeListeners() {
+	for _, f := range proxy.forwarders {
+		f.close()
+	}
+}
+
+// Addr returns the first bound address, or nil if the proxy is not listening
+func (proxy *Proxy) Addr() net.Addr {
+	if len(proxy.forwarders) == 0 {
+		return nil
+	}
+	return proxy.forwarders[0].addr()
+}
+
+// Addrs returns the bound addresses, SourceAddr first then the forwards in order
+func (proxy *Proxy) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, f := range proxy.forwarders {
+		addrs = append(addrs, f.addr())
+	}
+	return addrs
+}
+
+// Serve proxies connections until ctx is done. Listen must be called first.
+func (proxy *Proxy) Serve(ctx context.Context) error {
+	if len(proxy.forwarders) == 0 {
+		return errors.New("proxy is not listening")
+	}
+
+	var err error
+	if proxy.healthCheckEnabled() {
+		for _, f := range proxy.forwarders {
+			go proxy.checkHealth(f.upstreams, ctx.Done())
+		}
+		for _, p := range proxy.sniPools {
+			go proxy.checkHealth(p, ctx.Done())
+		}
+	}
+	if set(proxy.CaptureFile) {
+		if proxy.capture, err = createPcap(*proxy.CaptureFile); err != nil {
+			return err
+		}
+		defer proxy.capture.Close()
+		proxy.log().Printf("Capturing connections to %s", *proxy.CaptureFile)
+	}
+	if set(proxy.RecordFile) {
+		if proxy.recorder, err = replay.CreateRecorder(*proxy.RecordFile); err != nil {
+			return err
+		}
+		defer proxy.recorder.Close()
+		proxy.log().Printf("Recording connections to %s", *proxy.RecordFile)
+	}
+	if set(proxy.AdminAddr) {
+		listener, err := net.Listen("tcp", *proxy.AdminAddr)
+		if err != nil {
+			return err
+		}
+		admin := &http.Server{Handler: proxy.AdminHandler()}
+		go admin.Serve(listener)
+		defer admin.Close()
+		proxy.log().Printf("Admin api listening on %s", listener.Addr())
+	}
+	if set(proxy.Dump) {
+		output := proxy.DumpOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		max := 0
+		if proxy.DumpMax != nil {
+			max = *proxy.DumpMax
+		}
+		if proxy.dumper, err = newDumper(*proxy.Dump, max, output); err != nil {
+			return err
+		}
+	}
+
+	// Stop listening when context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		proxy.closeListeners()
+	}()
+
+	// Connections outlive ctx until drained
+	connCtx, force := context.WithCancel(context.Background())
+	defer force()
+	var wg sync.WaitGroup
+
+	// Each listener has its own accept loop, the first one to fail stops the others
+	errs := make(chan error, len(proxy.forwarders))
+	for _, f := range proxy.forwarders {
+		go func(f *forwarder) {
+			if f.packetConn != nil {
+				errs <- newUDPProxy(proxy, f.packetConn, f.upstreams).serve(ctx)
+			} else {
+				errs <- proxy.serveTCP(ctx, connCtx, f, &wg)
+			}
+		}(f)
+	}
+	err = <-errs
+	proxy.closeListeners()
+	for i := 1; i < len(proxy.forwarders); i++ {
+		<-errs
+	}
+	if !proxy.udp() {
+		proxy.drain(&wg, force)
+	}
+	if ctx.Err() != nil {
+		return nil
 	}
-	defer listener.Close()
-	proxy.log().Printf("Listening on %s", *proxy.SourceAddr)
+	return err
+}
+
+// Run listens and proxies connections until ctx is done
+func (proxy *Proxy) Run(ctx context.Context) error {
+	if err := proxy.Listen(); err != nil {
+		return err
+	}
+	return proxy.Serve(ctx)
+}
 
+// serveTCP accepts connections of a forwarder until its listener is closed.
+// Connections are handled with connCtx and tracked in wg to be drained.
+func (proxy *Proxy) serveTCP(ctx context.Context, connCtx context.Context, f *forwarder, wg *sync.WaitGroup) error {
 	for {
-		conn, err := listener.Accept()
+		conn, err := f.listener.Accept()
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
-		proxy.log().Printf("Go connection from %s", conn.RemoteAddr())
-		go proxy.handle(conn)
+		if !proxy.ACL.AllowedAddr(conn.RemoteAddr().String()) {
+			proxy.log().Printf("Denied connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		// Global limits hold before a goroutine is started, so clients sending nothing can't pile up
+		if proxy.limiter != nil {
+			if err := proxy.limiter.acquireSlot(ctx, proxy.limitWait()); err != nil {
+				proxy.reject(conn, err)
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if proxy.limiter != nil {
+				defer proxy.limiter.releaseSlot()
+			}
+			// The per ip limit applies to the client given by the PROXY header
+			conn, err := proxy.acceptHeader(conn)
+			if err != nil {
+				failedConnections.Inc()
+				return
+			}
+			if proxy.limiter != nil {
+				source := sourceIP(conn.RemoteAddr())
+				if err := proxy.limiter.acquireSource(ctx, source, proxy.limitWait()); err != nil {
+					proxy.reject(conn, err)
+					return
+				}
+				defer proxy.limiter.releaseSource(source)
+			}
+
+			proxy.log().Printf("Go connection from %s", conn.RemoteAddr())
+			acceptedConnections.Inc()
+			atomic.AddInt64(&proxy.active, 1)
+			activeConnections.Inc()
+			defer func() {
+				activeConnections.Dec()
+				atomic.AddInt64(&proxy.active, -1)
+				atomic.AddInt64(&proxy.closed, 1)
+			}()
+			proxy.handle(connCtx, conn, f.upstreams)
+		}()
+	}
+}
+
+// reject closes a connection over the limits
+func (proxy *Proxy) reject(conn net.Conn, err error) {
+	proxy.log().Printf("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
+	rejectedConnections.Inc()
+	conn.Close()
+}
+
+func (proxy *Proxy) drainTimeout() time.Duration {
+	if proxy.DrainTimeout == nil {
+		return 0
 	}
+	return *proxy.DrainTimeout
+}
+
+// drain waits for open connections up to the drain timeout, then force them closed
+func (proxy *Proxy) drain(wg *sync.WaitGroup, force context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	draining := atomic.LoadInt64(&proxy.active)
+	if draining > 0 {
+		proxy.log().Printf("Draining %d connections for up to %s", draining, proxy.drainTimeout())
+	}
+
+	var forced int64
+	select {
+	case <-done:
+	case <-time.After(proxy.drainTimeout()):
+		forced = atomic.LoadInt64(&proxy.active)
+		proxy.log().Printf("Drain timeout, forcing %d connections closed", forced)
+		force()
+		<-done
+	}
+
+	proxy.log().Printf("Closed %d connections (%d drained, %d forced)",
+		atomic.LoadInt64(&proxy.closed),
+		draining-forced,
+		forced)
+}
+
+// pipeBufferSize is the size of the chunks copied by pipe
+const pipeBufferSize = 32 * 1024
+
+// direction of a proxied chunk
+type direction int
+
+const (
+	// toTarget is the client to target direction
+	toTarget direction = iota
+	// toClient is the target to client direction
+	toClient
+)
+
+func (d direction) reverse() direction {
+	return 1 - d
 }
 
 type proxyRequest struct {
+	// offset is the number of bytes read so far, indexed by direction (atomic)
+	offset [2]int64
+	// lastSeen is the unix nano time of the last read in either direction (atomic)
+	lastSeen int64
+
+	id     uint64
 	proxy  *Proxy
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	client  net.Conn
+	server  net.Conn
+	target  string
+	started time.Time
+
+	capture *pcapStream
+	mirror  *mirror
+	// counted adds proxied bytes to the proxy metrics, Join requests are not counted
+	counted bool
 }
 
-func (r *proxyRequest) pipe(input io.Reader, output io.Writer) error {
+// observe hands a chunk read in a direction to the request observers
+func (r *proxyRequest) observe(dir direction, chunk []byte) {
+	if r.capture != nil {
+		r.capture.data(dir, chunk)
+	}
+	if r.mirror != nil && dir == toTarget {
+		r.mirror.send(chunk)
+	}
+	if r.proxy != nil && r.proxy.recorder != nil {
+		direction := replay.ToTarget
+		if dir == toClient {
+			direction = replay.ToClient
+		}
+		r.proxy.record(replay.Event{
+			Conn:      r.id,
+			Type:      replay.Data,
+			Time:      time.Since(r.started),
+			Direction: direction,
+			Data:      chunk,
+		})
+	}
+	if r.proxy != nil && r.proxy.dumper != nil {
+		r.proxy.dumper.dump(r.id, dir, atomic.LoadInt64(&r.offset[dir]), chunk)
+	}
+	atomic.AddInt64(&r.offset[dir], int64(len(chunk)))
+	if r.counted {
+		proxiedBytes.Add(float64(len(chunk)), dir.label())
+	}
+}
+
+func (r *proxyRequest) pipe(dir direction, input io.Reader, output io.Writer) error {
 	defer func() {
 		r.cancel()
 	}()
 
+	// Chunks go through a delay queue once the impairment adds latency, keeping them in order
+	var queue *delayQueue
+	defer func() {
+		if queue != nil {
+			queue.close()
+		}
+	}()
+
+	buf := make([]byte, pipeBufferSize)
 	for {
 		select {
 		case <-r.ctx.Done():
-			break
+			return nil
 		default:
-			_, err := io.Copy(output, input)
+		}
+
+		n, err := input.Read(buf)
+		if n > 0 {
+			r.touch()
+			latency, err := r.impair()
+			if err != nil {
+				return err
+			}
+			r.observe(dir, buf[:n])
+			if latency > 0 && queue == nil {
+				queue = r.delayQueue(dir, output)
+			}
+			if queue != nil {
+				err = queue.push(r.ctx, buf[:n], latency)
+			} else {
+				r.throttle(dir, n)
+				_, err = output.Write(buf[:n])
+			}
 			if err != nil {
 				return err
 			}
+		}
+		if err == io.EOF {
+			if queue != nil {
+				return queue.flush(r.ctx)
+			}
 			return nil
 		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func (r *proxyRequest) copyConn(input io.Reader, output io.Writer) {
-	if err := r.pipe(input, output); err != nil {
+func (r *proxyRequest) copyConn(dir direction, input io.Reader, output io.Writer) {
+	if err := r.pipe(dir, input, output); err != nil {
 		select {
 		case <-r.ctx.Done():
 			// Don't print error - context is done so we closed stream so pending read/write may fail !
 		default:
-			fmt.Fprintln(os.Stderr, err)
+			r.proxy.log().Printf("Error during copy: %v", err)
 		}
 		return
 	}
 }
 
-func (proxy *Proxy) handle(inputConn net.Conn) {
-	proxy.log().Printf("Opening proxy to %s/%s for %s", *proxy.TargetAddr, *proxy.Protocol, inputConn.RemoteAddr())
-	outputConn, err := net.DialTimeout(*proxy.Protocol, *proxy.TargetAddr, *proxy.DialTimeOut)
-	if err != nil {
-		proxy.log().Fatalf("Failed to dial %s/%s", *proxy.TargetAddr, *proxy.Protocol)
-		os.Exit(1)
+// record writes a session event, logging failures
+func (proxy *Proxy) record(e replay.Event) {
+	if err := proxy.recorder.Record(e); err != nil {
+		proxy.log().Printf("Failed to record connection #%d: %v", e.Conn, err)
 	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	r := proxyRequest{
-		proxy:  proxy,
-		ctx:    ctx,
-		cancel: cancel,
+// join copies data in both directions until one side closes or the request is done, then closes both sides
+func (r *proxyRequest) join() {
+	r.touch()
+	if idle, lifetime := r.proxy.timeouts(); idle > 0 || lifetime > 0 {
+		go r.expire(idle, lifetime)
 	}
 
+	// Read proxy
+	go r.copyConn(toTarget, r.client, r.server)
+	// Write proxy
+	go r.copyConn(toClient, r.server, r.client)
+
 	// Close stream
-	go func() {
-		<-ctx.Done()
+	<-r.ctx.Done()
+	r.client.Close()
+	r.server.Close()
+}
+
+// bufferedConn reads a connection through a reader that may hold data already received
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// JoinBuffered is Join for a client connection read through r, such as a hijacked http connection,
+// so the data r already buffered is proxied first.
+func JoinBuffered(ctx context.Context, client net.Conn, r *bufio.Reader, server net.Conn, log *quietlog.QuietLogger) {
+	Join(ctx, &bufferedConn{Conn: client, r: r}, server, log)
+}
+
+// Join copies data between client and server until one side closes or ctx is done, then closes both.
+// Copy errors are reported on log.
+func Join(ctx context.Context, client net.Conn, server net.Conn, log *quietlog.QuietLogger) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := proxyRequest{
+		proxy:   &Proxy{Log: log},
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  client,
+		server:  server,
+		target:  server.RemoteAddr().String(),
+		started: time.Now(),
+	}
+	r.join()
+}
+
+func (proxy *Proxy) acceptProxy() bool {
+	return proxy.AcceptProxy != nil && *proxy.AcceptProxy
+}
+
+// acceptHeader reads the PROXY header of a client connection as configured.
+// The connection is closed on failure.
+func (proxy *Proxy) acceptHeader(conn net.Conn) (net.Conn, error) {
+	if !proxy.acceptProxy() {
+		return conn, nil
+	}
+	c, err := proxy.acceptProxyHeader(conn)
+	if err != nil {
+		proxy.log().Printf("Invalid PROXY header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// accept completes the tls handshake of a client connection as configured.
+// The connection is closed on failure.
+func (proxy *Proxy) accept(conn net.Conn) (net.Conn, error) {
+	if proxy.serverTLS != nil {
+		c, err := proxy.terminate(conn)
+		if err != nil {
+			proxy.log().Printf("TLS handshake failed for %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil, err
+		}
+		conn = c
+	}
+
+	return conn, nil
+}
+
+// handle proxies a client connection to one of upstreams until one side closes or ctx is done
+func (proxy *Proxy) handle(ctx context.Context, inputConn net.Conn, upstreams *pool) {
+	inputConn, err := proxy.accept(inputConn)
+	if err != nil {
+		failedConnections.Inc()
+		return
+	}
+
+	if proxy.sniPools != nil {
+		if inputConn, upstreams, err = proxy.routeSNI(inputConn, upstreams); err != nil {
+			failedConnections.Inc()
+			return
+		}
+	}
+
+	outputConn, target, err := proxy.dialRetry(ctx, upstreams, inputConn.RemoteAddr(), inputConn.LocalAddr())
+	if err != nil {
+		proxy.log().Printf("Failed to dial any target for %s, closing connection: %v", inputConn.RemoteAddr(), err)
+		failedConnections.Inc()
 		inputConn.Close()
-		outputConn.Close()
+		return
+	}
+	target.acquire()
+	var mirror *mirror
+	if set(proxy.Mirror) {
+		mirror = proxy.openMirror(ctx, *proxy.Mirror)
+	}
+	proxy.log().Printf("Opening proxy to %s for %s", proxy.label(target.addr), inputConn.RemoteAddr())
 
-		proxy.log().Printf("Closing proxy to %s/%s for %s", *proxy.TargetAddr, *proxy.Protocol, inputConn.RemoteAddr())
-	}()
+	ctx, cancel := context.WithCancel(ctx)
+	r := proxyRequest{
+		id:      atomic.AddUint64(&proxy.nextID, 1),
+		proxy:   proxy,
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  inputConn,
+		server:  outputConn,
+		target:  target.addr,
+		started: time.Now(),
+		mirror:  mirror,
+		counted: true,
+	}
+	proxy.track(&r)
+	defer proxy.untrack(&r)
+	if proxy.recorder != nil {
+		proxy.record(replay.Event{
+			Conn:   r.id,
+			Type:   replay.Open,
+			Start:  &r.started,
+			Client: inputConn.RemoteAddr().String(),
+			Target: target.addr,
+		})
+	}
+	if proxy.capture != nil {
+		r.capture = proxy.capture.stream(inputConn.RemoteAddr(), outputConn.RemoteAddr())
+	}
 
-	// Read proxy
-	go r.copyConn(inputConn, outputConn)
-	// Write proxy
-	go r.copyConn(outputConn, inputConn)
+	r.join()
+	target.release()
+	if r.mirror != nil {
+		r.mirror.close()
+	}
+	if proxy.recorder != nil {
+		proxy.record(replay.Event{Conn: r.id, Type: replay.Close, Time: time.Since(r.started)})
+	}
+	if r.capture != nil {
+		r.capture.close()
+	}
+
+	proxy.log().Printf("Closing proxy to %s for %s", proxy.label(target.addr), inputConn.RemoteAddr())
 }
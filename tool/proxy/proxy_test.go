@@ -2,8 +2,17 @@ package proxy
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/pijalu/kitchensink/acl"
+	"github.com/pijalu/kitchensink/tool/replay"
 )
 
 func _TestCopyConn(t *testing.T, expected string) {
@@ -15,7 +24,7 @@ func _TestCopyConn(t *testing.T, expected string) {
 		ctx:    ctx,
 		cancel: cancel,
 	}
-	r.copyConn(input, &output)
+	r.copyConn(toTarget, input, &output)
 
 	actual := output.String()
 	if expected != actual {
@@ -34,3 +43,219 @@ func TestCopyConn(t *testing.T) {
 		_TestCopyConn(t, testCase)
 	}
 }
+
+func tcpEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func testProxy(target string) *Proxy {
+	quiet := true
+	source := "127.0.0.1:0"
+	protocol := "tcp"
+	timeout := time.Second
+	return &Proxy{
+		QuietFlag:   &quiet,
+		SourceAddr:  &source,
+		TargetAddrs: []string{target},
+		Protocol:    &protocol,
+		DialTimeOut: &timeout,
+	}
+}
+
+func TestRun(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- proxy.Serve(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "Hello World"
+	if _, err := conn.Write([]byte(expected)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf); actual != expected {
+		t.Fatalf("Expected %s but got %s", expected, actual)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected clean stop but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not stop when context was cancelled")
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	proxy := testProxy("127.0.0.1:1")
+	source := "256.0.0.1:0"
+	proxy.SourceAddr = &source
+
+	if err := proxy.Run(context.Background()); err == nil {
+		t.Fatal("Expected listen error")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	for _, closeClient := range []bool{true, false} {
+		proxy := testProxy(echo.Addr().String())
+		drain := 200 * time.Millisecond
+		proxy.DrainTimeout = &drain
+		if err := proxy.Listen(); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- proxy.Serve(ctx)
+		}()
+
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping"))
+		io.ReadFull(conn, make([]byte, 4))
+
+		start := time.Now()
+		cancel()
+		if closeClient {
+			conn.Close()
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+
+		if closeClient && elapsed >= drain {
+			t.Fatalf("Expected drain to end when client closed but took %s", elapsed)
+		}
+		if !closeClient && elapsed < drain {
+			t.Fatalf("Expected drain to wait for timeout but took %s", elapsed)
+		}
+		if proxy.closed != 1 {
+			t.Fatalf("Expected 1 closed connection but got %d", proxy.closed)
+		}
+	}
+}
+
+func TestRunDenied(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	list, err := acl.New(nil, []string{"127.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.ACL = list
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("denied connection should be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("denied connection should be closed, not left open")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "kitchensink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxy := testProxy(echo.Addr().String())
+	file := filepath.Join(dir, "session.jsonl")
+	proxy.RecordFile = &file
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- proxy.Serve(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	cancel()
+	<-done
+
+	sessions, err := replay.LoadSessions(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Target != echo.Addr().String() || len(sessions[0].Chunks) != 2 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	for i, direction := range []string{replay.ToTarget, replay.ToClient} {
+		chunk := sessions[0].Chunks[i]
+		if chunk.Direction != direction || string(chunk.Data) != "hello" {
+			t.Errorf("unexpected chunk %d: %+v", i, chunk)
+		}
+	}
+}
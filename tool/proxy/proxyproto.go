@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol versions
+const (
+	// ProxyProtoV1 is the human readable PROXY protocol header
+	ProxyProtoV1 = "v1"
+	// ProxyProtoV2 is the binary PROXY protocol header
+	ProxyProtoV2 = "v2"
+)
+
+// proxyProtoV2Sig starts all PROXY protocol v2 headers
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyProtoV1 is the maximum length of a v1 header, including CRLF
+const maxProxyProtoV1 = 107
+
+// PROXY protocol v2 commands and families
+const (
+	proxyProtoV2Local = 0x20
+	proxyProtoV2Proxy = 0x21
+	proxyProtoV2TCP4  = 0x11
+	proxyProtoV2TCP6  = 0x21
+)
+
+// tcpAddrs returns src and dst as tcp addresses if both are of the same ip family
+func tcpAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	if (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return nil, nil, false
+	}
+	return s, d, true
+}
+
+// writeProxyHeader sends a PROXY protocol header announcing a connection from src to dst
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, d, ok := tcpAddrs(src, dst)
+
+	var header []byte
+	switch version {
+	case ProxyProtoV1:
+		switch {
+		case !ok:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case s.IP.To4() != nil:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+		default:
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+		}
+	case ProxyProtoV2:
+		var buf bytes.Buffer
+		buf.Write(proxyProtoV2Sig)
+		switch {
+		case !ok:
+			buf.Write([]byte{proxyProtoV2Local, 0x00, 0x00, 0x00})
+		case s.IP.To4() != nil:
+			buf.Write([]byte{proxyProtoV2Proxy, proxyProtoV2TCP4, 0x00, 12})
+			buf.Write(s.IP.To4())
+			buf.Write(d.IP.To4())
+		default:
+			buf.Write([]byte{proxyProtoV2Proxy, proxyProtoV2TCP6, 0x00, 36})
+			buf.Write(s.IP.To16())
+			buf.Write(d.IP.To16())
+		}
+		if ok {
+			binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+			binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+		}
+		header = buf.Bytes()
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %s", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// readProxyHeader parses a v1 or v2 PROXY protocol header.
+// Nil addresses are returned for UNKNOWN and LOCAL headers.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyProtoV1 {
+			return nil, nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip string, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port %s", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtoV2Sig)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	command := header[12]
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if command&0xF0 != 0x20 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %#x", command>>4)
+	}
+	if command == proxyProtoV2Local {
+		return nil, nil, nil
+	}
+
+	var size int
+	switch family {
+	case proxyProtoV2TCP4:
+		size = net.IPv4len
+	case proxyProtoV2TCP6:
+		size = net.IPv6len
+	default:
+		// Unsupported family: keep connection addresses
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("PROXY protocol v2 header too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return src, dst, nil
+}
+
+// proxyProtoConn is a connection whose addresses come from a PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// acceptProxyHeader reads the PROXY protocol header of a client connection
+func (proxy *Proxy) acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(*proxy.DialTimeOut))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	src, dst, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if src != nil {
+		proxy.log().Printf("PROXY header from %s: client is %s", conn.RemoteAddr(), src)
+	}
+	return &proxyProtoConn{
+		Conn:   conn,
+		r:      r,
+		remote: src,
+		local:  dst,
+	}, nil
+}
+
+func (proxy *Proxy) sendProxy() string {
+	if proxy.SendProxy == nil {
+		return ""
+	}
+	return *proxy.SendProxy
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, version := range []string{ProxyProtoV1, ProxyProtoV2} {
+		for _, addrs := range [][2]string{
+			{"192.168.0.1:56324", "10.0.0.1:443"},
+			{"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		} {
+			src, _ := net.ResolveTCPAddr("tcp", addrs[0])
+			dst, _ := net.ResolveTCPAddr("tcp", addrs[1])
+
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+
+			r := bufio.NewReader(&buf)
+			actualSrc, actualDst, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s %v: %v", version, addrs, err)
+			}
+			if actualSrc.String() != src.String() || actualDst.String() != dst.String() {
+				t.Fatalf("%s: expected %s -> %s but got %s -> %s", version, src, dst, actualSrc, actualDst)
+			}
+
+			rest, _ := r.ReadString(0)
+			if rest != "payload" {
+				t.Fatalf("%s: expected payload to be kept but got %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	for _, version := range []string{ProxyProtoV1, ProxyProtoV2} {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, version, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		src, dst, err := readProxyHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src != nil || dst != nil {
+			t.Fatalf("%s: expected no addresses but got %s -> %s", version, src, dst)
+		}
+	}
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 1.2.3.4\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80 99999\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+	} {
+		if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Fatalf("Expected error for %q", header)
+		}
+	}
+}
+
+func TestWriteProxyHeaderUnknownVersion(t *testing.T) {
+	if err := writeProxyHeader(&bytes.Buffer{}, "v3", nil, nil); err == nil {
+		t.Fatal("Expected error for unknown version")
+	}
+}
+
+func TestSendAndAcceptProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	// Front proxy sends a header to the back proxy, which accepts it and sends its own to target
+	back := testProxy(target.Addr().String())
+	accept := true
+	back.AcceptProxy = &accept
+	v1 := ProxyProtoV1
+	back.SendProxy = &v1
+	if err := back.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	front := testProxy(back.Addr().String())
+	v2 := ProxyProtoV2
+	front.SendProxy = &v2
+	if err := front.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go back.Serve(ctx)
+	go front.Serve(ctx)
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	conn, err := target.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	src, dst, err := readProxyHeader(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != client.LocalAddr().String() {
+		t.Fatalf("Expected client %s but got %s", client.LocalAddr(), src)
+	}
+	if dst.String() != front.Addr().String() {
+		t.Fatalf("Expected destination %s but got %s", front.Addr(), dst)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errSniffed stops the tls handshake once the client hello is read
+var errSniffed = errors.New("client hello sniffed")
+
+// sniffConn feeds a tls handshake with client data and drops its replies
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c sniffConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn replays the data read while peeking before the rest of the connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// peekServerName reads the server name of a tls client hello.
+// The returned connection replays the client hello.
+func peekServerName(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hello bytes.Buffer
+	var name string
+	config := &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errSniffed
+		},
+	}
+	err := tls.Server(sniffConn{Conn: conn, r: io.TeeReader(conn, &hello)}, config).Handshake()
+	if err != errSniffed {
+		return nil, "", fmt.Errorf("no tls client hello: %v", err)
+	}
+	return &peekedConn{Conn: conn, r: io.MultiReader(&hello, conn)}, name, nil
+}
+
+// sniRoutes builds a pool per SNI route host
+func (proxy *Proxy) sniRoutes() (map[string]*pool, error) {
+	var hosts []string
+	targets := make(map[string][]string)
+	for _, route := range proxy.SNIRoutes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid SNI route %q, expected host=target", route)
+		}
+		host := strings.ToLower(parts[0])
+		if _, ok := targets[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		targets[host] = append(targets[host], parts[1])
+	}
+
+	pools := make(map[string]*pool)
+	for _, host := range hosts {
+		p, err := newPool(proxy.strategy(), targets[host])
+		if err != nil {
+			return nil, err
+		}
+		pools[host] = p
+		proxy.log().Printf("Routing %s to %s", host, strings.Join(targets[host], ", "))
+	}
+	return pools, nil
+}
+
+// sniPool returns the pool routing a server name, the most specific wildcard winning, or nil
+func (proxy *Proxy) sniPool(name string) *pool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if p, ok := proxy.sniPools[name]; ok {
+		return p
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if p, ok := proxy.sniPools["*"+name[i:]]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// routeSNI returns the pool of a tls client from its server name, or the fallback pool.
+// The connection is closed on failure.
+func (proxy *Proxy) routeSNI(conn net.Conn, fallback *pool) (net.Conn, *pool, error) {
+	peeked, name, err := peekServerName(conn, *proxy.DialTimeOut)
+	if err != nil {
+		proxy.log().Printf("Failed to read server name from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if p := proxy.sniPool(name); p != nil {
+		proxy.log().Printf("Routing %s for server name %q", conn.RemoteAddr(), name)
+		return peeked, p, nil
+	}
+	proxy.log().Printf("Routing %s for server name %q to default targets", conn.RemoteAddr(), name)
+	return peeked, fallback, nil
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// tlsNamed accepts tls connections, answering with name
+func tlsNamed(t *testing.T, dir string, name string) net.Listener {
+	certFile, keyFile := writeTestCert(t, dir, name)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.WriteString(conn, name)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestSNIRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitchensink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := tlsNamed(t, dir, "a")
+	defer a.Close()
+	b := tlsNamed(t, dir, "b")
+	defer b.Close()
+	fallback := tlsNamed(t, dir, "default")
+	defer fallback.Close()
+
+	proxy := testProxy(fallback.Addr().String())
+	proxy.SNIRoutes = []string{
+		"a.test=" + a.Addr().String(),
+		"*.b.test=" + b.Addr().String(),
+	}
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	for serverName, expected := range map[string]string{
+		"A.test":     "a",
+		"x.y.b.test": "b",
+		"b.test":     "default",
+		"":           "default",
+	} {
+		conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		got, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		if string(got) != expected {
+			t.Errorf("%q: expected %s, got %s", serverName, expected, got)
+		}
+	}
+}
+
+func TestSNIRoutingNotTLS(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	proxy.SNIRoutes = []string{"a.test=" + echo.Addr().String()}
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	if got, _ := ioutil.ReadAll(conn); len(got) != 0 {
+		t.Fatalf("plain connection should be closed, got %q", got)
+	}
+}
+
+func TestSNIRoutesInvalid(t *testing.T) {
+	for _, routes := range [][]string{
+		{"a.test"},
+		{"=127.0.0.1:443"},
+		{"a.test="},
+	} {
+		proxy := testProxy("127.0.0.1:1")
+		proxy.SNIRoutes = routes
+		if err := proxy.Listen(); err == nil {
+			proxy.closeListeners()
+			t.Errorf("%v: expected error", routes)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// set returns true if a string flag holds a value
+func set(value *string) bool {
+	return value != nil && *value != ""
+}
+
+// loadCertPool reads a PEM CA bundle
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsTermination returns true if the proxy listener accepts tls
+func (proxy *Proxy) tlsTermination() bool {
+	return set(proxy.TLSCertFile) || set(proxy.TLSKeyFile)
+}
+
+// serverTLSConfig builds the tls config of the listener
+func (proxy *Proxy) serverTLSConfig() (*tls.Config, error) {
+	if !set(proxy.TLSCertFile) || !set(proxy.TLSKeyFile) {
+		return nil, errors.New("both tls certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*proxy.TLSCertFile, *proxy.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		PreferServerCipherSuites: true,
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519,
+		},
+	}
+
+	if set(proxy.TLSClientCAFile) {
+		pool, err := loadCertPool(*proxy.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// terminate wraps a client connection in tls and completes the handshake
+func (proxy *Proxy) terminate(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, proxy.serverTLS)
+	tlsConn.SetDeadline(time.Now().Add(*proxy.DialTimeOut))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// clientTLSConfig builds the tls config used to dial targets, or nil if targets are plaintext
+func (proxy *Proxy) clientTLSConfig() (*tls.Config, error) {
+	if proxy.TargetTLS == nil || !*proxy.TargetTLS {
+		if set(proxy.TargetSNI) || set(proxy.TargetCAFile) || set(proxy.TargetCertFile) || set(proxy.TargetKeyFile) ||
+			(proxy.TargetInsecure != nil && *proxy.TargetInsecure) {
+			return nil, errors.New("target tls options require tls origination")
+		}
+		return nil, nil
+	}
+	if proxy.udp() {
+		return nil, errors.New("tls origination is not supported over udp")
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: proxy.TargetInsecure != nil && *proxy.TargetInsecure,
+	}
+	if set(proxy.TargetSNI) {
+		config.ServerName = *proxy.TargetSNI
+	}
+
+	if set(proxy.TargetCAFile) {
+		pool, err := loadCertPool(*proxy.TargetCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if set(proxy.TargetCertFile) || set(proxy.TargetKeyFile) {
+		if !set(proxy.TargetCertFile) || !set(proxy.TargetKeyFile) {
+			return nil, errors.New("both target client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(*proxy.TargetCertFile, *proxy.TargetKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// originate wraps a target connection in tls and completes the handshake.
+// Unix socket targets have no host to default the server name to.
+func (proxy *Proxy) originate(conn net.Conn, network string, addr string) (net.Conn, error) {
+	config := proxy.targetTLS.Clone()
+	if config.ServerName == "" && network != "unix" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(*proxy.DialTimeOut))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
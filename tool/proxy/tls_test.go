@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate valid for 127.0.0.1 and returns the cert and key files
+func writeTestCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+"-cert.pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSTermination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitchensink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	proxy := testProxy(echo.Addr().String())
+	proxy.TLSCertFile = &certFile
+	proxy.TLSKeyFile = &keyFile
+	proxy.TLSClientCAFile = &clientCert
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	roots, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "Hello World"
+	conn.Write([]byte(expected))
+	buf := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf); actual != expected {
+		t.Fatalf("Expected %s but got %s", expected, actual)
+	}
+
+	// Without client certificate
+	conn, err = tls.Dial("tcp", proxy.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(buf)
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected connection without client certificate to fail")
+	}
+}
+
+func TestTLSOrigination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitchensink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs, err := loadCertPool(clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	enabled := true
+	sni := "server"
+	proxy := testProxy(echo.Addr().String())
+	proxy.TargetTLS = &enabled
+	proxy.TargetSNI = &sni
+	proxy.TargetCAFile = &certFile
+	proxy.TargetCertFile = &clientCert
+	proxy.TargetKeyFile = &clientKey
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Serve(ctx)
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "Hello World"
+	conn.Write([]byte(expected))
+	buf := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf); actual != expected {
+		t.Fatalf("Expected %s but got %s", expected, actual)
+	}
+
+	// Wrong server name must fail verification
+	proxy.targetTLS.ServerName = "other"
+	if _, _, err := proxy.dial(ctx, nil, nil); err == nil {
+		t.Fatal("Expected dial with wrong server name to fail")
+	}
+}
+
+func TestTLSClientCAWithoutTermination(t *testing.T) {
+	ca := "ca.pem"
+	proxy := testProxy("127.0.0.1:1")
+	proxy.TLSClientCAFile = &ca
+	if err := proxy.Listen(); err == nil {
+		proxy.closeListeners()
+		t.Fatal("Expected a client CA without certificate and key to be rejected")
+	}
+}
+
+func TestTargetTLSOptionsWithoutOrigination(t *testing.T) {
+	sni := "example.com"
+	insecure := true
+	for _, option := range []func(*Proxy){
+		func(p *Proxy) { p.TargetSNI = &sni },
+		func(p *Proxy) { p.TargetInsecure = &insecure },
+	} {
+		proxy := testProxy("127.0.0.1:1")
+		option(proxy)
+		if err := proxy.Listen(); err == nil {
+			proxy.closeListeners()
+			t.Fatal("Expected target tls options without target tls to be rejected")
+		}
+	}
+}
+
+func TestTLSTerminationUDP(t *testing.T) {
+	cert, key := "cert.pem", "key.pem"
+	protocol := "udp"
+	proxy := testProxy("127.0.0.1:1")
+	proxy.Protocol = &protocol
+	proxy.TLSCertFile = &cert
+	proxy.TLSKeyFile = &key
+	if err := proxy.Listen(); err == nil {
+		proxy.closeListeners()
+		t.Fatal("Expected tls termination over udp to be rejected")
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpBufferSize is large enough to hold any udp datagram
+const udpBufferSize = 64 * 1024
+
+// udpPendingMax is the number of datagrams queued while a session opens, later ones are dropped
+const udpPendingMax = 16
+
+// udpSession holds the upstream socket used for one udp client
+type udpSession struct {
+	// lastSeen is the unix nano time of the last packet (atomic)
+	lastSeen int64
+
+	client net.Addr
+	// target and upstream are set once the session is open, guarded by the udpProxy lock
+	target   *upstream
+	upstream net.Conn
+	// pending holds the datagrams received while opening
+	pending [][]byte
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+}
+
+// udpProxy keeps the session table of a udp proxy, indexed by client address
+type udpProxy struct {
+	proxy     *Proxy
+	conn      net.PacketConn
+	upstreams *pool
+
+	m        sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUDPProxy(proxy *Proxy, conn net.PacketConn, upstreams *pool) *udpProxy {
+	return &udpProxy{
+		proxy:     proxy,
+		conn:      conn,
+		upstreams: upstreams,
+		sessions:  make(map[string]*udpSession),
+	}
+}
+
+// session returns the session of a client, and true if it was just created and must be opened
+func (u *udpProxy) session(client net.Addr) (*udpSession, bool) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if s, ok := u.sessions[client.String()]; ok {
+		return s, false
+	}
+	s := &udpSession{client: client}
+	s.touch()
+	u.sessions[client.String()] = s
+	return s, true
+}
+
+// open dials the target of a new session, then sends the datagrams queued meanwhile.
+// It runs off the read loop so a slow dial only delays the datagrams of this client.
+func (u *udpProxy) open(ctx context.Context, s *udpSession) {
+	upstream, target, err := u.proxy.dialPool(ctx, u.upstreams, s.client, nil)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.sessions[s.client.String()] != s {
+		// Closed while dialing
+		if err == nil {
+			upstream.Close()
+		}
+		return
+	}
+	if err != nil {
+		delete(u.sessions, s.client.String())
+		u.proxy.log().Printf("Failed to dial any target for %s: %v", s.client, err)
+		return
+	}
+
+	target.acquire()
+	u.proxy.log().Printf("Opening proxy to %s/%s for %s", target.addr, *u.proxy.Protocol, s.client)
+	s.target = target
+	s.upstream = upstream
+	for _, datagram := range s.pending {
+		if _, err := upstream.Write(datagram); err != nil {
+			u.proxy.log().Printf("Failed to forward packet from %s: %v", s.client, err)
+		}
+	}
+	s.pending = nil
+
+	go u.reply(s)
+}
+
+// forward sends a client datagram to the session target, queuing it while the session opens
+func (u *udpProxy) forward(s *udpSession, datagram []byte) {
+	u.m.Lock()
+	upstream := s.upstream
+	if upstream == nil {
+		if len(s.pending) < udpPendingMax {
+			s.pending = append(s.pending, append([]byte(nil), datagram...))
+		}
+		u.m.Unlock()
+		return
+	}
+	u.m.Unlock()
+
+	if _, err := upstream.Write(datagram); err != nil {
+		u.proxy.log().Printf("Failed to forward packet from %s: %v", s.client, err)
+	}
+}
+
+// reply routes upstream datagrams back to the session client
+func (u *udpProxy) reply(s *udpSession) {
+	defer u.close(s)
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		s.touch()
+		if _, err := u.conn.WriteTo(buf[:n], s.client); err != nil {
+			u.proxy.log().Printf("Failed to reply to %s: %v", s.client, err)
+			return
+		}
+	}
+}
+
+// close removes a session from the table and releases its upstream socket
+func (u *udpProxy) close(s *udpSession) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if u.sessions[s.client.String()] != s {
+		return
+	}
+	delete(u.sessions, s.client.String())
+	if s.upstream == nil {
+		// Still opening, the dial result is dropped
+		return
+	}
+	s.upstream.Close()
+	s.target.release()
+
+	u.proxy.log().Printf("Closing proxy to %s/%s for %s", s.target.addr, *u.proxy.Protocol, s.client)
+}
+
+// expire closes sessions idle for more than timeout
+func (u *udpProxy) expire(timeout time.Duration) {
+	now := time.Now()
+
+	u.m.Lock()
+	var expired []*udpSession
+	for _, s := range u.sessions {
+		if s.idle(now) > timeout {
+			expired = append(expired, s)
+		}
+	}
+	u.m.Unlock()
+
+	for _, s := range expired {
+		u.close(s)
+	}
+}
+
+// closeAll closes all sessions
+func (u *udpProxy) closeAll() {
+	u.m.Lock()
+	var sessions []*udpSession
+	for _, s := range u.sessions {
+		sessions = append(sessions, s)
+	}
+	u.m.Unlock()
+
+	for _, s := range sessions {
+		u.close(s)
+	}
+}
+
+// serve reads client datagrams and forwards them until the packet conn fails
+func (u *udpProxy) serve(ctx context.Context) error {
+	defer u.closeAll()
+
+	timeout := u.proxy.udpIdleTimeout()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				u.expire(timeout)
+			}
+		}
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !u.proxy.ACL.AllowedAddr(client.String()) {
+			continue
+		}
+
+		s, created := u.session(client)
+		if created {
+			go u.open(ctx, s)
+		}
+		s.touch()
+		u.forward(s, buf[:n])
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func udpEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPProxy(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	quiet := true
+	protocol := "udp"
+	target := echo.LocalAddr().String()
+	timeout := time.Second
+	idle := 100 * time.Millisecond
+	proxy := &Proxy{
+		QuietFlag:      &quiet,
+		Protocol:       &protocol,
+		TargetAddrs:    []string{target},
+		DialTimeOut:    &timeout,
+		UDPIdleTimeout: &idle,
+	}
+	upstreams, err := proxy.upstreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUDPProxy(proxy, listener, upstreams)
+	go u.serve(context.Background())
+
+	clients := make([]net.Conn, 2)
+	for i := range clients {
+		client, err := net.Dial("udp", listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients[i] = client
+	}
+
+	buf := make([]byte, udpBufferSize)
+	for i, client := range clients {
+		expected := []string{"hello", "world"}[i]
+		if _, err := client.Write([]byte(expected)); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(buf[:n]); actual != expected {
+			t.Fatalf("Expected %s but got %s", expected, actual)
+		}
+	}
+
+	u.m.Lock()
+	sessions := len(u.sessions)
+	u.m.Unlock()
+	if sessions != 2 {
+		t.Fatalf("Expected 2 sessions but got %d", sessions)
+	}
+
+	u.expire(0)
+	u.m.Lock()
+	sessions = len(u.sessions)
+	u.m.Unlock()
+	if sessions != 0 {
+		t.Fatalf("Expected sessions to be expired but got %d", sessions)
+	}
+}
+
+func TestUDPPendingDatagrams(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	quiet := true
+	protocol := "udp"
+	timeout := time.Second
+	proxy := &Proxy{
+		QuietFlag:   &quiet,
+		Protocol:    &protocol,
+		TargetAddrs: []string{echo.LocalAddr().String()},
+		DialTimeOut: &timeout,
+	}
+	upstreams, err := proxy.upstreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUDPProxy(proxy, listener, upstreams)
+	defer u.closeAll()
+
+	// Datagrams received while the session opens are sent once it is open
+	s, created := u.session(client.LocalAddr())
+	if !created {
+		t.Fatal("Expected a new session")
+	}
+	u.forward(s, []byte("hello"))
+	if again, created := u.session(client.LocalAddr()); created || again != s {
+		t.Fatal("Expected the opening session to be reused")
+	}
+	u.open(context.Background(), s)
+
+	buf := make([]byte, udpBufferSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf[:n]); actual != "hello" {
+		t.Fatalf("Expected hello but got %s", actual)
+	}
+}
@@ -0,0 +1,272 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pijalu/kitchensink/quietlog"
+)
+
+// Server is a fake server answering clients from recorded sessions
+type Server struct {
+	// next is the index of the next session to replay (atomic)
+	next uint64
+
+	QuietFlag  *bool
+	SourceAddr *string
+	// Sessions are replayed in turn, one per client connection
+	Sessions []*Session
+	Log      *quietlog.QuietLogger
+
+	listener net.Listener
+}
+
+// Quiet returns true if the tool should keep being quiet
+func (s *Server) Quiet() bool {
+	return (s.QuietFlag != nil) && *s.QuietFlag
+}
+
+func (s *Server) log() *quietlog.QuietLogger {
+	if s.Log == nil {
+		s.Log = quietlog.DefaultLogger(s)
+	}
+	return s.Log
+}
+
+// Listen binds the server source address. Use Addr to get the bound address.
+func (s *Server) Listen() error {
+	if len(s.Sessions) == 0 {
+		return errors.New("no session to replay")
+	}
+	listener, err := net.Listen("tcp", *s.SourceAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.log().Printf("Listening on %s, replaying %d sessions", listener.Addr(), len(s.Sessions))
+	return nil
+}
+
+// Addr returns the bound address, or nil if the server is not listening
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve answers clients until ctx is done. Listen must be called first.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.listener == nil {
+		return errors.New("replay server is not listening")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		i := atomic.AddUint64(&s.next, 1) - 1
+		session := s.Sessions[i%uint64(len(s.Sessions))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, conn, session)
+		}()
+	}
+}
+
+// Run listens and answers clients until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(ctx)
+}
+
+// handle plays the target side of a session: it reads what the client sent and writes what the target answered
+func (s *Server) handle(ctx context.Context, conn net.Conn, session *Session) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	s.log().Printf("Replaying session %d for %s", session.Conn, conn.RemoteAddr())
+	for i, chunk := range session.Chunks {
+		if chunk.Direction == ToClient {
+			if _, err := conn.Write(chunk.Data); err != nil {
+				s.log().Printf("Session %d: failed to write chunk %d: %v", session.Conn, i, err)
+				return
+			}
+			continue
+		}
+
+		got := make([]byte, len(chunk.Data))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			s.log().Printf("Session %d: failed to read chunk %d: %v", session.Conn, i, err)
+			return
+		}
+		if !bytes.Equal(got, chunk.Data) {
+			s.log().Printf("Session %d: client sent different data than recorded in chunk %d", session.Conn, i)
+		}
+	}
+	s.log().Printf("Replayed session %d for %s", session.Conn, conn.RemoteAddr())
+}
+
+// Client replays the client side of recorded sessions against a target, at the original pace
+type Client struct {
+	QuietFlag  *bool
+	TargetAddr *string
+	Sessions   []*Session
+	// Timeout is the time given to connect and to receive each chunk
+	Timeout *time.Duration
+	Log     *quietlog.QuietLogger
+}
+
+// Quiet returns true if the tool should keep being quiet
+func (c *Client) Quiet() bool {
+	return (c.QuietFlag != nil) && *c.QuietFlag
+}
+
+func (c *Client) log() *quietlog.QuietLogger {
+	if c.Log == nil {
+		c.Log = quietlog.DefaultLogger(c)
+	}
+	return c.Log
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == nil || *c.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return *c.Timeout
+}
+
+// Run replays all sessions, starting them with their recorded delays.
+// It fails if a session could not be replayed or got different answers than recorded.
+func (c *Client) Run(ctx context.Context) error {
+	if len(c.Sessions) == 0 {
+		return errors.New("no session to replay")
+	}
+
+	first := c.Sessions[0].Start
+	started := time.Now()
+	var failed int64
+	var wg sync.WaitGroup
+	for _, session := range c.Sessions {
+		// Keep the delay between connections
+		if !session.Start.IsZero() && !first.IsZero() {
+			if !sleep(ctx, session.Start.Sub(first)-time.Since(started)) {
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(session *Session) {
+			defer wg.Done()
+			if err := c.replay(ctx, session); err != nil {
+				c.log().Printf("Session %d: %v", session.Conn, err)
+				atomic.AddInt64(&failed, 1)
+			}
+		}(session)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sessions failed", failed, len(c.Sessions))
+	}
+	c.log().Printf("Replayed %d sessions", len(c.Sessions))
+	return nil
+}
+
+// sleep waits for d, returning false if ctx is done before
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// replay plays the client side of a session
+func (c *Client) replay(ctx context.Context, session *Session) error {
+	dialer := net.Dialer{Timeout: c.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", *c.TargetAddr)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	started := time.Now()
+	differs := false
+	for i, chunk := range session.Chunks {
+		if chunk.Direction == ToTarget {
+			if !sleep(ctx, chunk.Time-time.Since(started)) {
+				return ctx.Err()
+			}
+			if _, err := conn.Write(chunk.Data); err != nil {
+				return fmt.Errorf("failed to write chunk %d: %v", i, err)
+			}
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(c.timeout()))
+		got := make([]byte, len(chunk.Data))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %v", i, err)
+		}
+		if !bytes.Equal(got, chunk.Data) {
+			c.log().Printf("Session %d: target answered different data than recorded in chunk %d", session.Conn, i)
+			differs = true
+		}
+	}
+
+	if differs {
+		return errors.New("target answers differ from the recording")
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pingPong is a session answering pong to ping, twice
+func pingPong() []*Session {
+	return []*Session{{
+		Conn: 1,
+		Chunks: []Event{
+			{Type: Data, Direction: ToTarget, Data: []byte("ping")},
+			{Type: Data, Direction: ToClient, Data: []byte("pong")},
+			{Type: Data, Direction: ToTarget, Time: 50 * time.Millisecond, Data: []byte("ping")},
+			{Type: Data, Direction: ToClient, Data: []byte("pong")},
+		},
+	}}
+}
+
+func TestSessionFile(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	start := time.Now()
+	for _, e := range []Event{
+		{Conn: 1, Type: Open, Start: &start, Client: "127.0.0.1:1234", Target: "127.0.0.1:80"},
+		{Conn: 2, Type: Open, Client: "127.0.0.1:1235", Target: "127.0.0.1:80"},
+		{Conn: 1, Type: Data, Direction: ToTarget, Time: time.Millisecond, Data: []byte("hello")},
+		{Conn: 2, Type: Data, Direction: ToTarget, Data: []byte("other")},
+		{Conn: 1, Type: Data, Direction: ToClient, Time: 2 * time.Millisecond, Data: []byte{0, 1, 2}},
+		{Conn: 1, Type: Close},
+		{Conn: 2, Type: Close},
+	} {
+		if err := recorder.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ReadSessions(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	s := sessions[0]
+	if s.Conn != 1 || s.Client != "127.0.0.1:1234" || !s.Start.Equal(start) || len(s.Chunks) != 2 {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	if string(s.Chunks[0].Data) != "hello" || s.Chunks[0].Time != time.Millisecond ||
+		!bytes.Equal(s.Chunks[1].Data, []byte{0, 1, 2}) || s.Chunks[1].Direction != ToClient {
+		t.Fatalf("unexpected chunks %+v", s.Chunks)
+	}
+
+	for _, invalid := range []string{
+		`{"conn":1,"type":"data","direction":"to_target"}`,
+		`{"conn":1,"type":"open"}` + "\n" + `{"conn":1,"type":"data","direction":"up"}`,
+		`{"conn":1,"type":"reset"}`,
+		`{"conn":`,
+	} {
+		if _, err := ReadSessions(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	quiet := true
+	source := "127.0.0.1:0"
+	server := &Server{QuietFlag: &quiet, SourceAddr: &source, Sessions: pingPong()}
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx)
+	}()
+
+	// Sessions are replayed for each connection
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "pingping")
+		got := make([]byte, 8)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "pongpong" {
+			t.Fatalf("expected pongpong, got %q", got)
+		}
+		conn.Close()
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// answer serves a connection, answering reply to each 4 bytes read
+func answer(t *testing.T, reply string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					io.WriteString(conn, reply)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestClient(t *testing.T) {
+	quiet := true
+	timeout := time.Second
+	for reply, ok := range map[string]bool{"pong": true, "pang": false} {
+		target := answer(t, reply)
+		addr := target.Addr().String()
+		client := &Client{QuietFlag: &quiet, TargetAddr: &addr, Sessions: pingPong(), Timeout: &timeout}
+
+		started := time.Now()
+		err := client.Run(context.Background())
+		target.Close()
+		if ok && err != nil {
+			t.Fatalf("%s: %v", reply, err)
+		}
+		if !ok && err == nil {
+			t.Fatalf("%s: expected different answers error", reply)
+		}
+		if time.Since(started) < 50*time.Millisecond {
+			t.Fatalf("%s: chunks should be sent at the recorded pace", reply)
+		}
+	}
+}
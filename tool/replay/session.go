@@ -0,0 +1,158 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// Open starts a connection
+	Open = "open"
+	// Data is a chunk of data read on a connection
+	Data = "data"
+	// Close ends a connection
+	Close = "close"
+)
+
+// Directions of data events
+const (
+	// ToTarget is data sent by the client
+	ToTarget = "to_target"
+	// ToClient is data sent by the target
+	ToClient = "to_client"
+)
+
+// Event is a line of a session file
+type Event struct {
+	Conn uint64 `json:"conn"`
+	Type string `json:"type"`
+	// Time is the time since the connection opened, in nanoseconds
+	Time      time.Duration `json:"time"`
+	Direction string        `json:"direction,omitempty"`
+	Data      []byte        `json:"data,omitempty"`
+	// Start, Client and Target are set on open events
+	Start  *time.Time `json:"start,omitempty"`
+	Client string     `json:"client,omitempty"`
+	Target string     `json:"target,omitempty"`
+}
+
+// Session is the recorded events of a connection
+type Session struct {
+	Conn   uint64
+	Start  time.Time
+	Client string
+	Target string
+	// Chunks are the data events in order
+	Chunks []Event
+}
+
+// Recorder writes events to a session file, one JSON object per line
+type Recorder struct {
+	m   sync.Mutex
+	w   *bufio.Writer
+	c   io.Closer
+	enc *json.Encoder
+}
+
+// NewRecorder creates a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	buf := bufio.NewWriter(w)
+	return &Recorder{
+		w:   buf,
+		enc: json.NewEncoder(buf),
+	}
+}
+
+// CreateRecorder creates a recorder writing to a new file
+func CreateRecorder(file string) (*Recorder, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.c = f
+	return r, nil
+}
+
+// Record writes an event. Events are flushed when their connection closes.
+func (r *Recorder) Record(e Event) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := r.enc.Encode(e); err != nil {
+		return err
+	}
+	if e.Type == Close {
+		return r.w.Flush()
+	}
+	return nil
+}
+
+// Close flushes pending events and closes the file
+func (r *Recorder) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	err := r.w.Flush()
+	if r.c != nil {
+		if cerr := r.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ReadSessions reads the sessions of a session file, ordered by connection open
+func ReadSessions(r io.Reader) ([]*Session, error) {
+	var sessions []*Session
+	byConn := make(map[uint64]*Session)
+
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("event %d: %v", line, err)
+		}
+
+		switch e.Type {
+		case Open:
+			s := &Session{Conn: e.Conn, Client: e.Client, Target: e.Target}
+			if e.Start != nil {
+				s.Start = *e.Start
+			}
+			byConn[e.Conn] = s
+			sessions = append(sessions, s)
+		case Data:
+			s, ok := byConn[e.Conn]
+			if !ok {
+				return nil, fmt.Errorf("event %d: data for unknown connection %d", line, e.Conn)
+			}
+			if e.Direction != ToTarget && e.Direction != ToClient {
+				return nil, fmt.Errorf("event %d: unknown direction %q", line, e.Direction)
+			}
+			s.Chunks = append(s.Chunks, e)
+		case Close:
+		default:
+			return nil, fmt.Errorf("event %d: unknown type %q", line, e.Type)
+		}
+	}
+	return sessions, nil
+}
+
+// LoadSessions reads the sessions of a session file
+func LoadSessions(file string) ([]*Session, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSessions(f)
+}
@@ -0,0 +1,283 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pijalu/kitchensink/quietlog"
+)
+
+// Route sends requests matching a host and a path prefix to an upstream
+type Route struct {
+	// Host matches the request host without its port, any host if empty
+	Host string
+	// Prefix matches the request path on a segment boundary
+	Prefix string
+	Target *url.URL
+	// StripPrefix removes Prefix from the path sent to the upstream
+	StripPrefix bool
+}
+
+// ParseRoute parses a "[host]/prefix=http://upstream[/path][,strip]" route
+func ParseRoute(spec string) (Route, error) {
+	var route Route
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return route, fmt.Errorf("invalid route %q, expected [host]/prefix=url", spec)
+	}
+
+	match, target := parts[0], parts[1]
+	if i := strings.LastIndex(target, ","); i >= 0 {
+		for _, option := range strings.Split(target[i+1:], ",") {
+			if option != "strip" {
+				return route, fmt.Errorf("invalid route %q, unknown option %q", spec, option)
+			}
+			route.StripPrefix = true
+		}
+		target = target[:i]
+	}
+
+	slash := strings.Index(match, "/")
+	if slash < 0 {
+		return route, fmt.Errorf("invalid route %q, the path prefix must start with /", spec)
+	}
+	route.Host = strings.ToLower(match[:slash])
+	if host, _, err := net.SplitHostPort(route.Host); err == nil {
+		// Requests are routed on their host without the port
+		route.Host = host
+	}
+	route.Prefix = strings.TrimSuffix(match[slash:], "/")
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return route, fmt.Errorf("invalid route %q: %v", spec, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return route, fmt.Errorf("invalid route %q, the upstream must be a http or https url", spec)
+	}
+	route.Target = u
+	return route, nil
+}
+
+// matches returns true if the route handles host and path
+func (r *Route) matches(host string, path string) bool {
+	if r.Host != "" && r.Host != host {
+		return false
+	}
+	if !strings.HasPrefix(path, r.Prefix) {
+		return false
+	}
+	return len(path) == len(r.Prefix) || path[len(r.Prefix)] == '/'
+}
+
+// strip removes the route prefix from path
+func (r *Route) strip(path string) string {
+	if !r.StripPrefix {
+		return path
+	}
+	return strings.TrimPrefix(path, r.Prefix)
+}
+
+// HeaderRule changes a request header before it is sent to an upstream
+type HeaderRule struct {
+	Name string
+	// Value replaces the header, or the matches of Pattern if set
+	Value   string
+	Pattern *regexp.Regexp
+	Remove  bool
+}
+
+// ParseHeaderSet parses a "Name=value" rule setting a header
+func ParseHeaderSet(spec string) (HeaderRule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return HeaderRule{}, fmt.Errorf("invalid header %q, expected Name=value", spec)
+	}
+	return HeaderRule{Name: parts[0], Value: parts[1]}, nil
+}
+
+// ParseHeaderRemove parses a header name to remove
+func ParseHeaderRemove(spec string) (HeaderRule, error) {
+	if spec == "" {
+		return HeaderRule{}, fmt.Errorf("invalid header name %q", spec)
+	}
+	return HeaderRule{Name: spec, Remove: true}, nil
+}
+
+// ParseHeaderRewrite parses a "Name=regexp=>replacement" rule rewriting a header value
+func ParseHeaderRewrite(spec string) (HeaderRule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return HeaderRule{}, fmt.Errorf("invalid header rewrite %q, expected Name=regexp=>replacement", spec)
+	}
+	rewrite := strings.SplitN(parts[1], "=>", 2)
+	if len(rewrite) != 2 {
+		return HeaderRule{}, fmt.Errorf("invalid header rewrite %q, expected Name=regexp=>replacement", spec)
+	}
+	pattern, err := regexp.Compile(rewrite[0])
+	if err != nil {
+		return HeaderRule{}, fmt.Errorf("invalid header rewrite %q: %v", spec, err)
+	}
+	return HeaderRule{Name: parts[0], Value: rewrite[1], Pattern: pattern}, nil
+}
+
+// apply changes the headers of r. The Host header changes the request host.
+func (h *HeaderRule) apply(r *http.Request) {
+	host := http.CanonicalHeaderKey(h.Name) == "Host"
+	switch {
+	case h.Remove:
+		r.Header.Del(h.Name)
+	case h.Pattern != nil:
+		if host {
+			r.Host = h.Pattern.ReplaceAllString(r.Host, h.Value)
+			return
+		}
+		values := r.Header[http.CanonicalHeaderKey(h.Name)]
+		for i, value := range values {
+			values[i] = h.Pattern.ReplaceAllString(value, h.Value)
+		}
+	default:
+		if host {
+			r.Host = h.Value
+			return
+		}
+		r.Header.Set(h.Name, h.Value)
+	}
+}
+
+// Router routes requests to upstreams, and others to a fallback handler
+type Router struct {
+	QuietFlag *bool
+	Log       *quietlog.QuietLogger
+
+	routes   []Route
+	proxies  []*httputil.ReverseProxy
+	headers  []HeaderRule
+	fallback http.Handler
+}
+
+// NewRouter creates a router. Longer prefixes are matched first, and host routes before any host ones.
+// Requests matching no route go to fallback, or get a 404 if fallback is nil.
+func NewRouter(routes []Route, headers []HeaderRule, fallback http.Handler) *Router {
+	routes = append([]Route(nil), routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].Host == "") != (routes[j].Host == "") {
+			return routes[i].Host != ""
+		}
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+
+	router := &Router{
+		routes:   routes,
+		headers:  headers,
+		fallback: fallback,
+	}
+	for i := range routes {
+		router.proxies = append(router.proxies, router.reverseProxy(&router.routes[i]))
+	}
+	return router
+}
+
+// Quiet returns true if the tool should keep being quiet
+func (router *Router) Quiet() bool {
+	return (router.QuietFlag != nil) && *router.QuietFlag
+}
+
+func (router *Router) log() *quietlog.QuietLogger {
+	if router.Log == nil {
+		router.Log = quietlog.DefaultLogger(router)
+	}
+	return router.Log
+}
+
+// rewrite prepares r for the upstream of route
+func (router *Router) rewrite(route *Route, r *http.Request) {
+	target := route.Target
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = joinPath(target.Path, route.strip(r.URL.Path))
+	r.URL.RawPath = ""
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = target.RawQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// Don't let the upstream see the go default user agent
+		r.Header.Set("User-Agent", "")
+	}
+	for i := range router.headers {
+		router.headers[i].apply(r)
+	}
+}
+
+func (router *Router) reverseProxy(route *Route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			router.rewrite(route, r)
+		},
+		ErrorLog: log.New(logWriter{router}, "", 0),
+	}
+}
+
+// logWriter sends the lines of a standard logger to the router logger
+type logWriter struct {
+	router *Router
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.router.log().Printf("%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+// joinPath joins a base and a request path with a single slash
+func joinPath(base string, path string) string {
+	switch {
+	case path == "" && base == "":
+		return "/"
+	case path == "":
+		return base
+	case base == "" || base == "/":
+		return path
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
+
+// route returns the index of the route handling r, or -1
+func (router *Router) route(r *http.Request) int {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for i := range router.routes {
+		if router.routes[i].matches(host, r.URL.Path) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := router.route(r)
+	if i < 0 {
+		router.fallback.ServeHTTP(w, r)
+		return
+	}
+	router.proxies[i].ServeHTTP(w, r)
+}
@@ -0,0 +1,206 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRoute(t *testing.T) {
+	for spec, expected := range map[string]Route{
+		"/api=http://localhost:9000":               {Prefix: "/api"},
+		"/api/=http://localhost:9000/v1,strip":     {Prefix: "/api", StripPrefix: true},
+		"Api.Local/=https://localhost:9000":        {Host: "api.local"},
+		"api.local/admin=http://localhost:9000/x":  {Host: "api.local", Prefix: "/admin"},
+		"localhost:8080/api=http://localhost:9000": {Host: "localhost", Prefix: "/api"},
+	} {
+		route, err := ParseRoute(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if route.Host != expected.Host || route.Prefix != expected.Prefix || route.StripPrefix != expected.StripPrefix {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, route)
+		}
+	}
+
+	for _, spec := range []string{
+		"/api",
+		"api=http://localhost:9000",
+		"/api=localhost:9000",
+		"/api=ftp://localhost:9000",
+		"/api=http://localhost:9000,nostrip",
+	} {
+		if _, err := ParseRoute(spec); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestParseHeaderRules(t *testing.T) {
+	if _, err := ParseHeaderSet("X-Test"); err == nil {
+		t.Error("expected error without value")
+	}
+	if _, err := ParseHeaderRewrite("X-Test=nope"); err == nil {
+		t.Error("expected error without replacement")
+	}
+	if _, err := ParseHeaderRewrite("X-Test=(=>x"); err == nil {
+		t.Error("expected invalid regexp error")
+	}
+	if _, err := ParseHeaderRemove(""); err == nil {
+		t.Error("expected error without name")
+	}
+}
+
+// upstream answers with its name, the request path and the X-Test and Host headers
+func upstream(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s x=%s remove=%s host=%s", name, r.URL.RequestURI(), r.Header.Get("X-Test"), r.Header.Get("X-Remove"), r.Host)
+	}))
+}
+
+func mustRoute(t *testing.T, spec string) Route {
+	route, err := ParseRoute(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return route
+}
+
+func get(t *testing.T, url string, host string) string {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("X-Test", "hello world")
+	req.Header.Set("X-Remove", "present")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestRouter(t *testing.T) {
+	one := upstream("one")
+	defer one.Close()
+	two := upstream("two")
+	defer two.Close()
+
+	quiet := true
+	router := NewRouter([]Route{
+		mustRoute(t, "/api="+one.URL+"/base,strip"),
+		mustRoute(t, "/api/v2="+two.URL),
+		mustRoute(t, "static.local/="+two.URL),
+	}, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback")
+	}))
+	router.QuietFlag = &quiet
+	frontend := httptest.NewServer(router)
+	defer frontend.Close()
+
+	for _, tc := range []struct {
+		path     string
+		host     string
+		expected string
+	}{
+		{"/api/users?id=1", "", "one /base/users?id=1"},
+		{"/api", "", "one /base"},
+		{"/api/v2/users", "", "two /api/v2/users"},
+		{"/apiary", "", "fallback"},
+		{"/index.html", "", "fallback"},
+		{"/api/users", "static.local:8080", "two /api/users"},
+	} {
+		body := get(t, frontend.URL+tc.path, tc.host)
+		if len(body) < len(tc.expected) || body[:len(tc.expected)] != tc.expected {
+			t.Errorf("%s %s: expected %q, got %q", tc.host, tc.path, tc.expected, body)
+		}
+	}
+}
+
+func TestRouterHeaders(t *testing.T) {
+	one := upstream("one")
+	defer one.Close()
+
+	var rules []HeaderRule
+	for _, rule := range []func() (HeaderRule, error){
+		func() (HeaderRule, error) { return ParseHeaderRewrite("X-Test=world=>there") },
+		func() (HeaderRule, error) { return ParseHeaderRemove("X-Remove") },
+		func() (HeaderRule, error) { return ParseHeaderSet("Host=backend.local") },
+	} {
+		r, err := rule()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+
+	quiet := true
+	router := NewRouter([]Route{mustRoute(t, "/="+one.URL)}, rules, nil)
+	router.QuietFlag = &quiet
+	frontend := httptest.NewServer(router)
+	defer frontend.Close()
+
+	expected := "one / x=hello there remove= host=backend.local"
+	if body := get(t, frontend.URL, ""); body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "test" || r.URL.Path != "/ws" {
+			http.Error(w, "bad upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+	defer echo.Close()
+
+	quiet := true
+	router := NewRouter([]Route{mustRoute(t, "/socket="+echo.URL+"/ws,strip")}, nil, nil)
+	router.QuietFlag = &quiet
+	frontend := httptest.NewServer(router)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: frontend\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expected ping, got %q", buf)
+	}
+}
@@ -0,0 +1,408 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pijalu/kitchensink/acl"
+	"github.com/pijalu/kitchensink/quietlog"
+	"github.com/pijalu/kitchensink/tool/proxy"
+)
+
+// SOCKS5 protocol values (RFC 1928 and RFC 1929)
+const (
+	socksVersion = 5
+	authVersion  = 1
+
+	methodNone     = 0x00
+	methodPassword = 0x02
+	methodRejected = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSucceeded           = 0x00
+	repFailure             = 0x01
+	repNetworkUnreachable  = 0x03
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repCommandNotSupported = 0x07
+	repAddressNotSupported = 0x08
+)
+
+// Server is a SOCKS5 server
+type Server struct {
+	QuietFlag  *bool
+	SourceAddr *string
+	// Username and Password require clients to authenticate, no authentication if Username is empty
+	Username    *string
+	Password    *string
+	DialTimeOut *time.Duration
+	// ACL filters clients by ip, nil to allow everyone
+	ACL *acl.List
+	Log *quietlog.QuietLogger
+
+	listener net.Listener
+}
+
+// Quiet returns true if the tool should keep being quiet
+func (s *Server) Quiet() bool {
+	return (s.QuietFlag != nil) && *s.QuietFlag
+}
+
+func (s *Server) log() *quietlog.QuietLogger {
+	if s.Log == nil {
+		s.Log = quietlog.DefaultLogger(s)
+	}
+	return s.Log
+}
+
+func (s *Server) auth() bool {
+	return s.Username != nil && *s.Username != ""
+}
+
+func (s *Server) dialTimeout() time.Duration {
+	if s.DialTimeOut == nil {
+		return 0
+	}
+	return *s.DialTimeOut
+}
+
+// Listen binds the server source address. Use Addr to get the bound address.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", *s.SourceAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.log().Printf("Listening on %s", listener.Addr())
+	return nil
+}
+
+// Addr returns the bound address, or nil if the server is not listening
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve handles SOCKS5 clients until ctx is done. Listen must be called first.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.listener == nil {
+		return errors.New("socks server is not listening")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+		if !s.ACL.AllowedAddr(conn.RemoteAddr().String()) {
+			s.log().Printf("Denied connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// Run listens and handles SOCKS5 clients until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(ctx)
+}
+
+// handle runs a client connection until its command is done
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	// Close the connection if ctx is done during negotiation
+	negotiated := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-negotiated:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	err := s.negotiate(r, conn)
+	if err != nil {
+		close(negotiated)
+		s.log().Printf("Negotiation failed for %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	cmd, addr, err := readRequest(r)
+	close(negotiated)
+	if err != nil {
+		s.log().Printf("Invalid request from %s: %v", conn.RemoteAddr(), err)
+		if err == errAddressType {
+			writeReply(conn, repAddressNotSupported, nil)
+		}
+		conn.Close()
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.connect(ctx, conn, r, addr)
+	case cmdUDPAssociate:
+		s.associate(ctx, conn, r, addr)
+	default:
+		s.log().Printf("Unsupported command %d from %s", cmd, conn.RemoteAddr())
+		writeReply(conn, repCommandNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// negotiate selects the authentication method and authenticates the client
+func (s *Server) negotiate(r *bufio.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	expected := byte(methodNone)
+	if s.auth() {
+		expected = methodPassword
+	}
+	method := byte(methodRejected)
+	for _, m := range methods {
+		if m == expected {
+			method = m
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == methodRejected {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == methodPassword {
+		return s.authenticate(r, w)
+	}
+	return nil
+}
+
+// authenticate runs the username/password authentication of RFC 1929
+func (s *Server) authenticate(r *bufio.Reader, w io.Writer) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != authVersion {
+		return fmt.Errorf("unsupported authentication version %d", version)
+	}
+	username, err := readString(r)
+	if err != nil {
+		return err
+	}
+	password, err := readString(r)
+	if err != nil {
+		return err
+	}
+
+	ok := subtle.ConstantTimeCompare([]byte(username), []byte(*s.Username)) == 1
+	ok = subtle.ConstantTimeCompare([]byte(password), []byte(*s.Password)) == 1 && ok
+	status := byte(0)
+	if !ok {
+		status = 1
+	}
+	if _, err := w.Write([]byte{authVersion, status}); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("authentication failed for user %q", username)
+	}
+	return nil
+}
+
+// readString reads a string prefixed by its length
+func readString(r *bufio.Reader) (string, error) {
+	size, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+// readRequest reads the command and destination of a client request
+func readRequest(r *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	addr, err := readAddr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return header[1], addr, nil
+}
+
+// readAddr reads an address and port as "host:port"
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp[0] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errAddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddr appends the encoded address of addr, or of the unspecified address if addr is nil
+func appendAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, atypIPv4), ip4...)
+	} else if ip != nil {
+		b = append(append(b, atypIPv6), ip.To16()...)
+	} else {
+		b = append(b, atypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeReply sends a reply with the bound address
+func writeReply(w io.Writer, rep byte, bound net.Addr) error {
+	_, err := w.Write(appendAddr([]byte{socksVersion, rep, 0}, bound))
+	return err
+}
+
+// replyCode maps a dial error to a reply code
+func replyCode(err error) byte {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return repHostUnreachable
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return repHostUnreachable
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return repConnectionRefused
+	case syscall.ENETUNREACH:
+		return repNetworkUnreachable
+	case syscall.EHOSTUNREACH:
+		return repHostUnreachable
+	}
+	return repFailure
+}
+
+// connect runs a CONNECT command
+func (s *Server) connect(ctx context.Context, conn net.Conn, r *bufio.Reader, addr string) {
+	dialer := net.Dialer{Timeout: s.dialTimeout()}
+	target, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		s.log().Printf("Failed to connect %s to %s: %v", conn.RemoteAddr(), addr, err)
+		writeReply(conn, replyCode(err), nil)
+		conn.Close()
+		return
+	}
+	if err := writeReply(conn, repSucceeded, target.LocalAddr()); err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+
+	s.log().Printf("Opening connection to %s for %s", addr, conn.RemoteAddr())
+	proxy.JoinBuffered(ctx, conn, r, target, s.log())
+	s.log().Printf("Closing connection to %s for %s", addr, conn.RemoteAddr())
+}
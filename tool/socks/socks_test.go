@@ -0,0 +1,241 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func udpEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// testServer starts a server, stopped by the returned function
+func testServer(t *testing.T, username string, password string) (*Server, func()) {
+	quiet := true
+	source := "127.0.0.1:0"
+	timeout := time.Second
+	s := &Server{
+		QuietFlag:   &quiet,
+		SourceAddr:  &source,
+		Username:    &username,
+		Password:    &password,
+		DialTimeOut: &timeout,
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx)
+	}()
+	return s, func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// request negotiates and sends a command, returning the reply code and bound address
+func request(t *testing.T, conn net.Conn, methods []byte, auth []byte, cmd byte, addr net.Addr) (byte, string) {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] == methodRejected {
+		return methodRejected, ""
+	}
+	if reply[1] == methodPassword {
+		conn.Write(auth)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != 0 {
+			return methodRejected, ""
+		}
+	}
+
+	conn.Write(appendAddr([]byte{socksVersion, cmd, 0}, addr))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header[1], bound
+}
+
+func TestConnect(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s, stop := testServer(t, "", "")
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if rep, _ := request(t, conn, []byte{methodNone}, nil, cmdConnect, echo.Addr()); rep != repSucceeded {
+		t.Fatalf("expected success, got %d", rep)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected hello, got %q", buf)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr()
+	listener.Close()
+
+	s, stop := testServer(t, "", "")
+	defer stop()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if rep, _ := request(t, conn, []byte{methodNone}, nil, cmdConnect, closed); rep != repConnectionRefused {
+		t.Fatalf("expected connection refused, got %d", rep)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s, stop := testServer(t, "user", "secret")
+	defer stop()
+
+	for _, tc := range []struct {
+		methods  []byte
+		password string
+		expected byte
+	}{
+		{[]byte{methodNone}, "", methodRejected},
+		{[]byte{methodNone, methodPassword}, "wrong", methodRejected},
+		{[]byte{methodNone, methodPassword}, "secret", repSucceeded},
+	} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := append([]byte{authVersion, 4}, "user"...)
+		auth = append(append(auth, byte(len(tc.password))), tc.password...)
+		if rep, _ := request(t, conn, tc.methods, auth, cmdConnect, echo.Addr()); rep != tc.expected {
+			t.Errorf("methods %v, password %q: expected %d, got %d", tc.methods, tc.password, tc.expected, rep)
+		}
+		conn.Close()
+	}
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	s, stop := testServer(t, "", "")
+	defer stop()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// BIND
+	if rep, _ := request(t, conn, []byte{methodNone}, nil, 0x02, s.Addr()); rep != repCommandNotSupported {
+		t.Fatalf("expected command not supported, got %d", rep)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	s, stop := testServer(t, "", "")
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rep, bound := request(t, conn, []byte{methodNone}, nil, cmdUDPAssociate, nil)
+	if rep != repSucceeded {
+		t.Fatalf("expected success, got %d", rep)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := appendAddr([]byte{0, 0, 0}, echo.LocalAddr())
+	client.Write(append(packet, "ping"...))
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, udpBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(packet, "ping"...)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("expected %v, got %v", expected, buf[:n])
+	}
+}
@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// udpBufferSize is the largest udp datagram relayed
+const udpBufferSize = 64 * 1024
+
+// associate runs a UDP ASSOCIATE command, relaying datagrams until the control connection closes.
+// addr is the address the client expects to send datagrams from, with a 0 port if unknown.
+func (s *Server) associate(ctx context.Context, conn net.Conn, control io.Reader, addr string) {
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		s.log().Printf("Failed to open udp relay for %s: %v", conn.RemoteAddr(), err)
+		writeReply(conn, repFailure, nil)
+		return
+	}
+	defer relay.Close()
+	if err := writeReply(conn, repSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	s.log().Printf("Opening udp relay %s for %s", relay.LocalAddr(), conn.RemoteAddr())
+
+	// The association ends with the control connection
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, control)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		relay.Close()
+		conn.Close()
+	}()
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var client *net.UDPAddr
+	if expected, err := net.ResolveUDPAddr("udp", addr); err == nil && expected.Port != 0 {
+		client = &net.UDPAddr{IP: clientIP, Port: expected.Port}
+	}
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		if client == nil && from.IP.Equal(clientIP) {
+			client = from
+		}
+		if client != nil && from.IP.Equal(client.IP) && from.Port == client.Port {
+			s.forward(relay, buf[:n])
+		} else if client != nil {
+			// Reply from a destination, sent back with its source address
+			packet := appendAddr([]byte{0, 0, 0}, from)
+			packet = append(packet, buf[:n]...)
+			relay.WriteToUDP(packet, client)
+		}
+	}
+	s.log().Printf("Closing udp relay %s for %s", relay.LocalAddr(), conn.RemoteAddr())
+}
+
+// forward sends the data of a client datagram to its destination. Fragments are dropped.
+func (s *Server) forward(relay *net.UDPConn, packet []byte) {
+	if len(packet) < 4 || packet[0] != 0 || packet[1] != 0 || packet[2] != 0 {
+		return
+	}
+	r := bytes.NewReader(packet[3:])
+	addr, err := readAddr(r)
+	if err != nil {
+		return
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		s.log().Printf("Failed to resolve %s: %v", addr, err)
+		return
+	}
+	data := packet[len(packet)-r.Len():]
+	if _, err := relay.WriteToUDP(data, dst); err != nil {
+		s.log().Printf("Failed to relay datagram to %s: %v", dst, err)
+	}
+}
@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"io"
+
+	"github.com/pijalu/kitchensink/metrics"
+)
+
+var (
+	acceptedConnections = metrics.NewCounter("kitchensink_tunnel_connections_accepted_total",
+		"Number of accepted tunnel connections.")
+	activeConnections = metrics.NewGauge("kitchensink_tunnel_connections_active",
+		"Number of open tunnel connections.")
+	failedConnections = metrics.NewCounter("kitchensink_tunnel_connections_failed_total",
+		"Number of tunnel connections closed before reaching the target.")
+	tunneledBytes = metrics.NewCounter("kitchensink_tunnel_bytes_total",
+		"Number of tunneled bytes.", "direction")
+	sshConnections = metrics.NewCounter("kitchensink_tunnel_ssh_connections_total",
+		"Number of ssh connections opened, including reconnects.")
+	sshReconnects = metrics.NewCounter("kitchensink_tunnel_ssh_reconnects_total",
+		"Number of ssh connections opened to replace a closed one.")
+	dialDuration = metrics.NewHistogram("kitchensink_tunnel_dial_duration_seconds",
+		"Duration of ssh server and target dials.", nil, "dial")
+)
+
+// countingWriter counts bytes written under a direction label
+type countingWriter struct {
+	w         io.Writer
+	direction string
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	tunneledBytes.Add(float64(n), c.direction)
+	return n, err
+}
@@ -2,22 +2,29 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"os/user"
 
+	"github.com/pijalu/kitchensink/acl"
 	"github.com/pijalu/kitchensink/quietlog"
 	"golang.org/x/crypto/ssh"
 )
 
 // Config represents configuration for SSH tunnel
 type Config struct {
+	// tunnel counters (atomic), kept first for alignment
+	active int64
+	closed int64
+
 	QuietFlag *bool
 
 	Force *bool
@@ -34,7 +41,13 @@ type Config struct {
 	Password *string
 
 	DialTimeOut *time.Duration
-	Log         *quietlog.QuietLogger
+	// ACL filters clients by ip, nil to allow everyone
+	ACL *acl.List
+	// DrainTimeout is the time given to open tunnels to finish once the server stops
+	DrainTimeout *time.Duration
+	Log          *quietlog.QuietLogger
+
+	listener net.Listener
 }
 
 // Quiet returns true if the tool should keep being quiet
@@ -50,18 +63,45 @@ func (c *Config) log() *quietlog.QuietLogger {
 	return c.Log
 }
 
-// tunnelServer keeps the actual connection struct
-type tunnelServer struct {
-	c  *Config
-	m  sync.Mutex
-	wg sync.WaitGroup
-
+// sshConn is a ssh connection shared by tunnels
+type sshConn struct {
 	client *ssh.Client
+	// clients is the number of tunnels using the connection, protected by tunnelServer.m
+	clients int
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+// tunnelServer keeps the actual connection struct
+type tunnelServer struct {
+	c *Config
+	m sync.Mutex
+
+	conn *sshConn
+	// connected is true once a ssh connection was opened, later ones are reconnects
+	connected bool
+
+	// stop ends the accept loop
+	stop context.CancelFunc
+	// ctx is the parent context of ssh connections, cancelled by force
+	ctx   context.Context
+	force context.CancelFunc
+	err   error
+}
+
+// fail stops the server with err, closing all tunnels
+func (t *tunnelServer) fail(err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	t.stop()
+	t.force()
+}
+
 // loadKey load a private key and return signer
 func (t *tunnelServer) loadKey(privateKey string) (ssh.Signer, error) {
 	key, err := ioutil.ReadFile(privateKey)
@@ -78,7 +118,7 @@ func (t *tunnelServer) loadKey(privateKey string) (ssh.Signer, error) {
 }
 
 // clientConfig builds a client config
-func (t *tunnelServer) clientConfig() *ssh.ClientConfig {
+func (t *tunnelServer) clientConfig() (*ssh.ClientConfig, error) {
 	config := ssh.ClientConfig{
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		Timeout:         *t.c.DialTimeOut,
@@ -87,8 +127,7 @@ func (t *tunnelServer) clientConfig() *ssh.ClientConfig {
 	// Get current user
 	user, err := user.Current()
 	if err != nil {
-		t.c.log().Fatalf("Failed to determine current user: %v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to determine current user: %v", err)
 	}
 
 	// Username
@@ -107,11 +146,9 @@ func (t *tunnelServer) clientConfig() *ssh.ClientConfig {
 	if *t.c.KeyFile != "" {
 		signer, err := t.loadKey(*t.c.KeyFile)
 		if err != nil {
-			t.c.log().Fatalf("Failed to load key %s: %v", *t.c.KeyFile, err)
-			os.Exit(1)
-		} else {
-			t.c.log().Printf("Loaded key %s", *t.c.KeyFile)
+			return nil, fmt.Errorf("failed to load key %s: %v", *t.c.KeyFile, err)
 		}
+		t.c.log().Printf("Loaded key %s", *t.c.KeyFile)
 		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
 	} else { // load usual home key
 		for _, keyName := range []string{"id_rsa", "id_dsa"} {
@@ -130,49 +167,60 @@ func (t *tunnelServer) clientConfig() *ssh.ClientConfig {
 	}
 
 	if len(config.Auth) < 1 {
-		t.c.log().Fatalf("No authentiation method could be found !")
-		os.Exit(1)
+		return nil, errors.New("no authentication method could be found")
 	}
 
-	return &config
+	return &config, nil
 }
 
-func (t *tunnelServer) connect() error {
-	t.wg.Add(1)
-
+// connect returns the shared ssh connection, opening it as needed.
+// Callers must call release once done with the connection.
+func (t *tunnelServer) connect() (*sshConn, error) {
 	t.m.Lock()
 	defer t.m.Unlock()
 
-	if t.client != nil {
-		return nil
+	if t.conn != nil {
+		t.conn.clients++
+		return t.conn, nil
 	}
 
-	client, err := ssh.Dial("tcp", *t.c.SSHAddr, t.clientConfig())
+	config, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	client, err := ssh.Dial("tcp", *t.c.SSHAddr, config)
+	dialDuration.Observe(time.Since(start).Seconds(), "ssh")
 	if err != nil {
 		t.c.log().Printf("Failed to connect to %s: %v", *t.c.SSHAddr, err)
 		// We can't connect now but we should keep trying...
-		return err
+		return nil, err
 	}
-	t.client = client
-
-	// Start new root context
-	ctx, cancel := context.WithCancel(context.Background())
-	t.ctx = ctx
-	t.cancel = cancel
+	sshConnections.Inc()
+	if t.connected {
+		sshReconnects.Inc()
+	}
+	t.connected = true
 
 	// Start session
 	session, err := client.NewSession()
 	if err != nil {
 		t.c.log().Printf("Failed to start session on %s: %v", *t.c.SSHAddr, err)
-		// Cancel context/reset client
-		t.cancel()
-		t.client.Close()
-		t.client = nil
-		// Forget this WG
-		t.wg.Done()
-		return err
+		client.Close()
+		return nil, err
 	}
 
+	// Start new connection context
+	ctx, cancel := context.WithCancel(t.ctx)
+	conn := &sshConn{
+		client:  client,
+		clients: 1,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	t.conn = conn
+
 	// Run session
 	go func() {
 		if t.c.Quiet() {
@@ -188,122 +236,248 @@ func (t *tunnelServer) connect() error {
 			case <-ctx.Done():
 				/* ignore error as we are closing connection */
 			default:
-				t.c.log().Fatalf("Error running %s on  %s: %v",
+				t.c.log().Printf("Error running %s on  %s: %v",
 					*t.c.RemoteCmd,
 					*t.c.SSHAddr,
 					err)
 			}
 		}
 		t.c.log().Printf("Closing session on %s", *t.c.SSHAddr)
-		t.cancel()
-	}()
-
-	// Shutdown connection if no clients
-	go func() {
-		t.wg.Wait()
-		t.c.log().Printf("No more client, Sending close request for  %s", *t.c.SSHAddr)
-		// No more client running - close
-		t.cancel()
+		t.close(conn)
 	}()
 
 	// Close when context is done
 	go func() {
-		<-t.ctx.Done()
-		t.m.Lock()
-		defer t.m.Unlock()
+		<-ctx.Done()
+		t.close(conn)
 
-		t.c.log().Printf("No more client, Closing session to %s", *t.c.SSHAddr)
+		t.c.log().Printf("Closing session to %s", *t.c.SSHAddr)
 		// Closing session and client
 		session.Close()
 		client.Close()
-		// Reset
-		t.client = nil
 	}()
 
-	return nil
+	return conn, nil
 }
 
+// close cancels a ssh connection and forgets it so the next tunnel reconnects
+func (t *tunnelServer) close(conn *sshConn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.forget(conn)
+}
+
+// forget cancels a ssh connection and clears it if shared. t.m must be held.
+func (t *tunnelServer) forget(conn *sshConn) {
+	if t.conn == conn {
+		t.conn = nil
+	}
+	conn.cancel()
+}
+
+// release marks a tunnel as done, closing the ssh connection if it has no more client.
+// The connection is forgotten with the last client so connect can't share it while it closes.
+func (t *tunnelServer) release(conn *sshConn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	conn.clients--
+	if conn.clients == 0 {
+		t.c.log().Printf("No more client, Sending close request for  %s", *t.c.SSHAddr)
+		t.forget(conn)
+	}
+}
+
+// handle tunnels a client connection until one side closes or the ssh connection is done
 func (t *tunnelServer) handle(inputConn net.Conn) {
 	// Connect as needed
-	if err := t.connect(); err != nil {
+	conn, err := t.connect()
+	if err != nil {
+		failedConnections.Inc()
+		inputConn.Close()
 		if !*t.c.Force {
-			os.Exit(1)
+			t.fail(err)
 		}
+		return
 	}
+	// Clean up: Mark connection as done to close session if needed
+	defer t.release(conn)
 
-	outputConn, err := t.client.Dial(*t.c.Protocol, *t.c.TargetAddr)
+	start := time.Now()
+	outputConn, err := conn.client.Dial(*t.c.Protocol, *t.c.TargetAddr)
+	dialDuration.Observe(time.Since(start).Seconds(), "target")
 	if err != nil {
-		t.c.log().Printf("Failed to dial %s/%s", *t.c.TargetAddr, *t.c.Protocol)
-		if !*t.c.Force {
-			os.Exit(1)
-		}
+		t.c.log().Printf("Failed to dial %s/%s: %v", *t.c.TargetAddr, *t.c.Protocol, err)
+		failedConnections.Inc()
 		// Close input stream
 		inputConn.Close()
-		// Clean up: Mark connection as done to close session if needed
-		t.wg.Done()
+		if !*t.c.Force {
+			t.fail(err)
+		}
+		return
 	}
 
 	// Prepare context for connections copies
-	ctx, cancel := context.WithCancel(t.ctx)
-
-	// Cleanup goroutine, using copy context
-	go func() {
-		<-ctx.Done()
-		t.wg.Done()
-
-		inputConn.Close()
-		outputConn.Close()
-
-		t.c.log().Printf("Closing tunnel to %s/%s for %s",
-			*t.c.TargetAddr,
-			*t.c.Protocol,
-			inputConn.RemoteAddr())
-	}()
+	ctx, cancel := context.WithCancel(conn.ctx)
 
 	// Copy func
-	copyFunc := func(r io.Reader, w io.Writer) {
+	copyFunc := func(r io.Reader, w io.Writer, direction string) {
 		defer cancel()
-		_, err := io.Copy(w, r)
+		_, err := io.Copy(countingWriter{w, direction}, r)
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				/* no issues - we are closing */
 			default:
-				t.c.log().Fatalf("Error during copy: %v", err)
+				t.c.log().Printf("Error during copy: %v", err)
 			}
 		}
 	}
 
 	// Copy stream in both direction
-	go copyFunc(inputConn, outputConn)
-	go copyFunc(outputConn, inputConn)
+	go copyFunc(inputConn, outputConn, "to_target")
+	go copyFunc(outputConn, inputConn, "to_client")
+
+	// Cleanup, using copy context
+	<-ctx.Done()
+	inputConn.Close()
+	outputConn.Close()
+
+	t.c.log().Printf("Closing tunnel to %s/%s for %s",
+		*t.c.TargetAddr,
+		*t.c.Protocol,
+		inputConn.RemoteAddr())
 }
 
-// Run tunnel
-func (c *Config) Run() {
-	t := tunnelServer{
-		c: c,
-	}
-
-	listener, err := net.Listen(*t.c.Protocol, *t.c.SourceAddr)
+// Listen binds the tunnel source address. Use Addr to get the bound address.
+func (c *Config) Listen() error {
+	listener, err := net.Listen(*c.Protocol, *c.SourceAddr)
 	if err != nil {
-		t.c.log().Fatalf("Error listening on %s/%s: %v",
-			*t.c.SourceAddr,
-			*t.c.Protocol,
+		return fmt.Errorf("error listening on %s/%s: %v",
+			*c.SourceAddr,
+			*c.Protocol,
 			err)
-		os.Exit(1)
 	}
-	defer listener.Close()
-	t.c.log().Printf("Listening on %s", *t.c.SourceAddr)
+	c.listener = listener
+	c.log().Printf("Listening on %s", listener.Addr())
+	return nil
+}
+
+// Addr returns the bound address, or nil if the tunnel is not listening
+func (c *Config) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
 
+// Serve tunnels connections until ctx is done. Listen must be called first.
+func (c *Config) Serve(parent context.Context) error {
+	if c.listener == nil {
+		return errors.New("tunnel is not listening")
+	}
+
+	ctx, stop := context.WithCancel(parent)
+	defer stop()
+	// Tunnels outlive ctx until drained
+	connCtx, force := context.WithCancel(context.Background())
+	defer force()
+	t := tunnelServer{
+		c:     c,
+		stop:  stop,
+		ctx:   connCtx,
+		force: force,
+	}
+
+	// Stop listening when context is done
+	go func() {
+		<-ctx.Done()
+		c.listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	var err error
 	for {
-		conn, err := listener.Accept()
+		var conn net.Conn
+		conn, err = c.listener.Accept()
 		if err != nil {
-			t.c.log().Fatalf("Error during accept: %v",
-				err)
-			os.Exit(1)
+			break
+		}
+		if !c.ACL.AllowedAddr(conn.RemoteAddr().String()) {
+			t.c.log().Printf("Denied connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
 		}
 		t.c.log().Printf("Got connection from %s", conn.RemoteAddr())
-		go t.handle(conn)
+		acceptedConnections.Inc()
+
+		wg.Add(1)
+		atomic.AddInt64(&c.active, 1)
+		activeConnections.Inc()
+		go func() {
+			defer func() {
+				activeConnections.Dec()
+				atomic.AddInt64(&c.active, -1)
+				atomic.AddInt64(&c.closed, 1)
+				wg.Done()
+			}()
+			t.handle(conn)
+		}()
+	}
+	stop()
+	c.drain(&wg, force)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if parent.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("error during accept: %v", err)
+}
+
+func (c *Config) drainTimeout() time.Duration {
+	if c.DrainTimeout == nil {
+		return 0
+	}
+	return *c.DrainTimeout
+}
+
+// drain waits for open tunnels up to the drain timeout, then force them closed
+func (c *Config) drain(wg *sync.WaitGroup, force context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	draining := atomic.LoadInt64(&c.active)
+	if draining > 0 {
+		c.log().Printf("Draining %d tunnels for up to %s", draining, c.drainTimeout())
+	}
+
+	var forced int64
+	select {
+	case <-done:
+	case <-time.After(c.drainTimeout()):
+		forced = atomic.LoadInt64(&c.active)
+		c.log().Printf("Drain timeout, forcing %d tunnels closed", forced)
+		force()
+		<-done
+	}
+
+	c.log().Printf("Closed %d tunnels (%d drained, %d forced)",
+		atomic.LoadInt64(&c.closed),
+		draining-forced,
+		forced)
+}
+
+// Run listens and tunnels connections until ctx is done
+func (c *Config) Run(ctx context.Context) error {
+	if err := c.Listen(); err != nil {
+		return err
 	}
+	return c.Serve(ctx)
 }
@@ -0,0 +1,336 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pijalu/kitchensink/acl"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServer starts a ssh server accepting user/secret, running exec requests until the client leaves
+// and forwarding direct-tcpip channels
+func sshServer(t *testing.T) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			// The command runs until the client closes the session
+			go func() {
+				for req := range requests {
+					req.Reply(req.Type == "exec", nil)
+				}
+				channel.Close()
+			}()
+		case "direct-tcpip":
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+			if err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				upstream.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(channel, upstream)
+				channel.Close()
+			}()
+			go func() {
+				io.Copy(upstream, channel)
+				upstream.Close()
+			}()
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+		}
+	}
+}
+
+func tcpEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func testTunnel(sshAddr string, target string) *Config {
+	quiet := true
+	force := false
+	protocol := "tcp"
+	source := "127.0.0.1:0"
+	cmd := "sleep"
+	user := "user"
+	password := "secret"
+	key := ""
+	timeout := time.Second
+	drain := time.Second
+	return &Config{
+		QuietFlag:    &quiet,
+		Force:        &force,
+		Protocol:     &protocol,
+		SourceAddr:   &source,
+		SSHAddr:      &sshAddr,
+		TargetAddr:   &target,
+		RemoteCmd:    &cmd,
+		Username:     &user,
+		KeyFile:      &key,
+		Password:     &password,
+		DialTimeOut:  &timeout,
+		DrainTimeout: &drain,
+	}
+}
+
+// serve starts the tunnel, returning the channel receiving the Serve result
+func serve(ctx context.Context, t *testing.T, c *Config) chan error {
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Serve(ctx)
+	}()
+	return done
+}
+
+// echoThrough checks a message comes back through conn
+func echoThrough(t *testing.T, conn net.Conn) {
+	expected := "Hello World"
+	if _, err := conn.Write([]byte(expected)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf); actual != expected {
+		t.Fatalf("Expected %s but got %s", expected, actual)
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := sshServer(t)
+	defer server.Close()
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	c := testTunnel(server.Addr().String(), echo.Addr().String())
+	if c.Addr() != nil {
+		t.Fatal("Expected no address before Listen")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serve(ctx, t, c)
+	if addr, ok := c.Addr().(*net.TCPAddr); !ok || addr.Port == 0 {
+		t.Fatalf("Expected a bound port but got %v", c.Addr())
+	}
+
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn)
+	conn.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected clean stop but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return on cancel")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server := sshServer(t)
+	defer server.Close()
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	c := testTunnel(server.Addr().String(), echo.Addr().String())
+	drain := 200 * time.Millisecond
+	c.DrainTimeout = &drain
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serve(ctx, t, c)
+
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoThrough(t, conn)
+
+	// The open tunnel keeps working until the drain timeout
+	start := time.Now()
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	echoThrough(t, conn)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Expected clean stop but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < drain {
+		t.Fatalf("Expected drain to wait for timeout but took %s", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected forced tunnel to be closed")
+	}
+}
+
+func TestDenied(t *testing.T) {
+	server := sshServer(t)
+	defer server.Close()
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	c := testTunnel(server.Addr().String(), echo.Addr().String())
+	list, err := acl.New(nil, []string{"127.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ACL = list
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serve(ctx, t, c)
+
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if got, err := ioutil.ReadAll(conn); err != nil || len(got) != 0 {
+		t.Fatalf("Expected denied connection to be closed, got %q, %v", got, err)
+	}
+}
+
+func TestSSHFailure(t *testing.T) {
+	// Nothing listens on a closed listener address
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshAddr := closed.Addr().String()
+	closed.Close()
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	for _, force := range []bool{false, true} {
+		c := testTunnel(sshAddr, echo.Addr().String())
+		c.Force = &force
+		ctx, cancel := context.WithCancel(context.Background())
+		done := serve(ctx, t, c)
+
+		conn, err := net.Dial("tcp", c.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+
+		if !force {
+			// Without force, the first failure stops the tunnel
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("Expected ssh failure to stop the tunnel")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Tunnel kept running after ssh failure")
+			}
+			cancel()
+			continue
+		}
+
+		select {
+		case err := <-done:
+			t.Fatalf("Expected forced tunnel to keep running, got %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("Expected clean stop but got %v", err)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package waitconn
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"os"
 	"time"
 
 	"github.com/pijalu/kitchensink/quietlog"
@@ -36,17 +36,22 @@ func (w *Command) Addr(addr *string) *Command {
 	return w
 }
 
-// Run waitconn command
-func (w *Command) Run() {
+// Run waitconn command, returning an error if no connection could be made
+// within the number of tries or ctx is done
+func (w *Command) Run(ctx context.Context) error {
 	logger := quietlog.DefaultLogger(w)
 	logger.Printf("Checking for connection for %s/%s", *w.addr, *w.Protocol)
 
+	dialer := net.Dialer{Timeout: *w.ConnectionTimeout}
 	for t := 0; ; t++ {
-		conn, err := net.DialTimeout(*w.Protocol, *w.addr, *w.ConnectionTimeout)
+		conn, err := dialer.DialContext(ctx, *w.Protocol, *w.addr)
 		if err == nil {
 			logger.Printf("Connection successful !")
 			conn.Close()
-			break
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 		var prefix string
 		if *w.Tries != 0 && !w.Quiet() {
@@ -55,12 +60,15 @@ func (w *Command) Run() {
 
 		logger.Printf("%s No reply...", prefix)
 
-		if *w.Tries == 0 || t+1 < *w.Tries {
-			logger.Printf("Waiting for %s", w.WaitDelay)
-			time.Sleep(*w.WaitDelay)
-		} else {
-			logger.Printf("No reply after %d requests - stopping !", t+1)
-			os.Exit(-1)
+		if *w.Tries != 0 && t+1 >= *w.Tries {
+			return fmt.Errorf("no reply from %s/%s after %d requests", *w.addr, *w.Protocol, t+1)
+		}
+
+		logger.Printf("Waiting for %s", w.WaitDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*w.WaitDelay):
 		}
 	}
 }
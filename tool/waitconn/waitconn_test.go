@@ -0,0 +1,53 @@
+package waitconn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCommand(addr string, tries int) *Command {
+	quiet := true
+	protocol := "tcp"
+	wait := 10 * time.Millisecond
+	timeout := time.Second
+	return (&Command{
+		Protocol:          &protocol,
+		Tries:             &tries,
+		WaitDelay:         &wait,
+		ConnectionTimeout: &timeout,
+		QuietFlag:         &quiet,
+	}).Addr(&addr)
+}
+
+func TestRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if err := testCommand(listener.Addr().String(), 1).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunNoReply(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if err := testCommand(addr, 2).Run(context.Background()); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := testCommand(addr, 0).Run(ctx); err != context.Canceled {
+		t.Fatalf("Expected context error but got %v", err)
+	}
+}